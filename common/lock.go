@@ -2,7 +2,6 @@ package common
 
 import (
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -19,63 +18,78 @@ type MultipleLock interface {
 	RUnlock(interface{})
 }
 
+// lock keeps a mutex for every key in use, and puts it back into the pool once nobody holds or waits for it
 type lock struct {
-	inUse sync.Map
+	mu    sync.Mutex
+	inUse map[interface{}]*refCounter
 	pool  *sync.Pool
 }
 
 func (l *lock) TryLock(key interface{}, timeout time.Duration) bool {
-	m := l.getLocker(key)
-	atomic.AddInt64(&m.counter, 1)
+	m := l.acquire(key)
 	isLocked := m.lock.tryLock(timeout)
 	if !isLocked {
-		l.putBackInPool(key, m)
+		l.release(key, m)
 	}
 	return isLocked
 }
 
 func (l *lock) Lock(key interface{}) {
-	m := l.getLocker(key)
-	atomic.AddInt64(&m.counter, 1)
-	m.lock.lock()
+	l.acquire(key).lock.lock()
 }
 
 func (l *lock) Unlock(key interface{}) {
 	m := l.getLocker(key)
 	m.lock.unlock()
-	l.putBackInPool(key, m)
+	l.release(key, m)
 }
 
 func (l *lock) RLock(key interface{}) {
-	m := l.getLocker(key)
-	atomic.AddInt64(&m.counter, 1)
-	m.lock.rLock()
+	l.acquire(key).lock.rLock()
 }
 
 func (l *lock) RUnlock(key interface{}) {
 	m := l.getLocker(key)
 	m.lock.rUnlock()
-	l.putBackInPool(key, m)
+	l.release(key, m)
+}
+
+// acquire returns the mutex of the key, which is kept until it is released
+func (l *lock) acquire(key interface{}) *refCounter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	m, ok := l.inUse[key]
+	if !ok {
+		m = &refCounter{
+			lock: l.pool.Get().(*timedMutex),
+		}
+		l.inUse[key] = m
+	}
+	m.counter++
+	return m
 }
 
 func (l *lock) getLocker(key interface{}) *refCounter {
-	res, _ := l.inUse.LoadOrStore(key, &refCounter{
-		counter: 0,
-		lock:    l.pool.Get().(*timedMutex),
-	})
-	return res.(*refCounter)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.inUse[key]
 }
 
-func (l *lock) putBackInPool(key interface{}, m *refCounter) {
-	atomic.AddInt64(&m.counter, -1)
-	if m.counter <= 0 {
+func (l *lock) release(key interface{}, m *refCounter) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if m.counter--; m.counter <= 0 {
+		delete(l.inUse, key)
 		l.pool.Put(m.lock)
-		l.inUse.Delete(key)
 	}
 }
 
 func NewMultipleLock() MultipleLock {
 	return &lock{
+		inUse: make(map[interface{}]*refCounter),
 		pool: &sync.Pool{
 			New: newTimedMutex,
 		},
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMultipleLock(t *testing.T) {
+	l := NewMultipleLock()
+	var wg sync.WaitGroup
+	counters := map[string]*int{"a": new(int), "b": new(int)}
+	for i := 0; i < 100; i++ {
+		for _, key := range []string{"a", "b"} {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				l.Lock(key)
+				defer l.Unlock(key)
+				*counters[key]++
+			}(key)
+		}
+	}
+	wg.Wait()
+	if *counters["a"] != 100 || *counters["b"] != 100 {
+		t.Errorf("unexpected counters: %d, %d", *counters["a"], *counters["b"])
+	}
+	if n := len(l.(*lock).inUse); n != 0 {
+		t.Errorf("expected all locks to be released, %d are in use", n)
+	}
+}
+
+func TestMultipleLockTryLock(t *testing.T) {
+	l := NewMultipleLock()
+	l.Lock("a")
+	if l.TryLock("a", time.Millisecond*10) {
+		t.Fatal("locked twice")
+	}
+	l.RLock("b")
+	l.RLock("b")
+	l.Unlock("a")
+	if !l.TryLock("a", time.Millisecond*10) {
+		t.Fatal("not locked after unlocking")
+	}
+	l.Unlock("a")
+	l.RUnlock("b")
+	l.RUnlock("b")
+	if n := len(l.(*lock).inUse); n != 0 {
+		t.Errorf("expected all locks to be released, %d are in use", n)
+	}
+}
@@ -4,17 +4,22 @@ go 1.21
 
 require (
 	github.com/bluele/gcache v0.0.2
+	github.com/eclipse/paho.mqtt.golang v1.5.0
 	github.com/go-chi/chi/v5 v5.1.0
 	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/websocket v1.5.3
 	github.com/jrudio/go-plex-client v0.0.0-20220106065909-9e1d590b99aa
 	github.com/xanderstrike/plexhooks v0.0.0-20200926011736-c63bcd35fe3e
+	go.etcd.io/bbolt v1.3.10
 )
 
 require (
 	github.com/google/uuid v1.3.0 // indirect
-	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/onsi/ginkgo v1.16.5 // indirect
 	github.com/onsi/gomega v1.18.1 // indirect
+	golang.org/x/net v0.35.0 // indirect
+	golang.org/x/sync v0.7.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
 )
 
 replace github.com/jrudio/go-plex-client v0.0.0-20220106065909-9e1d590b99aa => github.com/RoyXiang/go-plex-client v0.0.0-20220313053419-e24ff7ada173
@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	accessAllow = "allow"
+	accessDeny  = "deny"
+)
+
+type accessRule struct {
+	Action   string   `json:"action"`
+	Users    []string `json:"users"`
+	Devices  []string `json:"devices"`
+	Products []string `json:"products"`
+	Networks []string `json:"networks"`
+
+	networks []*net.IPNet
+}
+
+type accessRequest struct {
+	user    *plexUser
+	device  string
+	product string
+	ip      net.IP
+}
+
+func newAccessRequest(r *http.Request) *accessRequest {
+	ar := &accessRequest{
+		device:  r.Header.Get(headerClientIdentity),
+		product: r.Header.Get(headerProduct),
+		ip:      net.ParseIP(getClientIP(r)),
+	}
+	if user := r.Context().Value(userCtxKey); user != nil {
+		ar.user = user.(*plexUser)
+	}
+	return ar
+}
+
+func (ar *accessRequest) String() string {
+	username := ""
+	if ar.user != nil {
+		username = ar.user.Username
+	}
+	return fmt.Sprintf("user=%q, device=%q, product=%q, ip=%s", username, ar.device, ar.product, ar.ip)
+}
+
+func (rule *accessRule) init() error {
+	switch rule.Action {
+	case accessAllow, accessDeny:
+	default:
+		return fmt.Errorf("invalid access action: %q", rule.Action)
+	}
+	rule.networks = make([]*net.IPNet, 0, len(rule.Networks))
+	for _, cidr := range rule.Networks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		rule.networks = append(rule.networks, network)
+	}
+	return nil
+}
+
+// match reports whether every criterion set in the rule is satisfied by the request
+func (rule *accessRule) match(ar *accessRequest) bool {
+	if len(rule.Users) > 0 && !matchUser(rule.Users, ar.user) {
+		return false
+	}
+	if len(rule.Devices) > 0 && !containsFold(rule.Devices, ar.device) {
+		return false
+	}
+	if len(rule.Products) > 0 && !containsFold(rule.Products, ar.product) {
+		return false
+	}
+	if len(rule.networks) > 0 {
+		if ar.ip == nil {
+			return false
+		}
+		matched := false
+		for _, network := range rule.networks {
+			if network.Contains(ar.ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *PlexClient) IsAccessAllowed(ar *accessRequest) bool {
+	for _, rule := range c.getRules().Access {
+		if rule.match(ar) {
+			return rule.Action == accessAllow
+		}
+	}
+	return true
+}
+
+func matchUser(users []string, user *plexUser) bool {
+	if user == nil {
+		return false
+	}
+	id := strconv.Itoa(user.Id)
+	for _, u := range users {
+		if u == id || strings.EqualFold(u, user.Username) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RoyXiang/plexproxy/common"
+	"github.com/jrudio/go-plex-client"
+)
+
+type terminatedSession struct {
+	SessionId string `json:"session_id"`
+	User      string `json:"user"`
+	Device    string `json:"device"`
+	Player    string `json:"player"`
+	Address   string `json:"address"`
+	Title     string `json:"title"`
+	Error     string `json:"error,omitempty"`
+}
+
+func (c *PlexClient) getOwner() *plexUser {
+	c.MulLock.RLock(lockKeyToken)
+	token := c.client.Token
+	c.MulLock.RUnlock(lockKeyToken)
+
+	if token == "" {
+		return nil
+	}
+	return c.GetUser(token)
+}
+
+func (c *PlexClient) IsOwner(user *plexUser) bool {
+	owner := c.getOwner()
+	return owner != nil && user != nil && owner.Id == user.Id
+}
+
+func (c *PlexClient) IsBanned(ar *accessRequest) bool {
+	keys := make([]string, 0, 3)
+	if ar.user != nil {
+		keys = append(keys, banKey("user", ar.user.Username), banKey("user", strconv.Itoa(ar.user.Id)))
+	}
+	if ar.device != "" {
+		keys = append(keys, banKey("device", ar.device))
+	}
+	for _, key := range keys {
+		if c.bans.Has(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *PlexClient) ban(kind, value string, duration time.Duration) {
+	_ = c.bans.SetWithExpire(banKey(kind, value), emptyStruct, duration)
+	common.GetLogger().Printf("Banned %s %q for %s", kind, value, duration)
+}
+
+func (c *PlexClient) TerminateSessions(w http.ResponseWriter, r *http.Request) {
+	username := r.FormValue("user")
+	device := r.FormValue("device")
+	ip := r.FormValue("ip")
+	if username == "" && device == "" && ip == "" {
+		http.Error(w, "one of user, device or ip is required", http.StatusBadRequest)
+		return
+	}
+	var banDuration time.Duration
+	if value := r.FormValue("ban"); value != "" {
+		var err error
+		if banDuration, err = time.ParseDuration(value); err != nil || banDuration <= 0 {
+			http.Error(w, "invalid ban duration", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// tracked sessions might have ended, so live ones are fetched from Plex
+	sessions, err := c.getLiveSessions()
+	if err != nil {
+		common.GetLogger().Printf("Failed to fetch playback sessions: %s", err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	matched := make([]plex.Metadata, 0)
+	for _, m := range sessions.MediaContainer.Metadata {
+		if username != "" && !strings.EqualFold(m.User.Title, username) && m.User.ID != username {
+			continue
+		}
+		if device != "" && m.Player.MachineIdentifier != device {
+			continue
+		}
+		if ip != "" && m.Player.Address != ip && m.Player.RemotePublicAddress != ip {
+			continue
+		}
+		matched = append(matched, m)
+	}
+
+	reason := r.FormValue("reason")
+	result := make([]terminatedSession, 0, len(matched))
+	for _, m := range matched {
+		ts := terminatedSession{
+			SessionId: m.Session.ID,
+			User:      m.User.Title,
+			Device:    m.Player.MachineIdentifier,
+			Player:    m.Player.Title,
+			Address:   m.Player.Address,
+			Title:     m.Title,
+		}
+		if err := c.terminateSession(m.Session.ID, reason); err != nil {
+			common.GetLogger().Printf("Failed to terminate session %s: %s", m.Session.ID, err.Error())
+			ts.Error = err.Error()
+		} else {
+			common.GetLogger().Printf("Terminated session %s of %q on %q", m.Session.ID, m.User.Title, m.Player.Title)
+		}
+		result = append(result, ts)
+	}
+
+	if banDuration > 0 {
+		if username != "" {
+			c.ban("user", username, banDuration)
+		}
+		if device != "" {
+			c.ban("device", device, banDuration)
+		}
+	}
+	writeJson(w, result)
+}
+
+func (c *PlexClient) getLiveSessions() (plex.CurrentSessions, error) {
+	c.MulLock.RLock(lockKeyToken)
+	defer c.MulLock.RUnlock(lockKeyToken)
+
+	return c.client.GetSessions()
+}
+
+func (c *PlexClient) terminateSession(sessionId, reason string) error {
+	c.MulLock.RLock(lockKeyToken)
+	defer c.MulLock.RUnlock(lockKeyToken)
+
+	return c.client.TerminateSession(sessionId, reason)
+}
+
+func banKey(kind, value string) string {
+	return kind + ":" + strings.ToLower(value)
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set(headerContentType, "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,89 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/RoyXiang/plexproxy/common"
+)
+
+var errUpstreamUnavailable = errors.New("plex media server is unavailable")
+
+type circuitBreaker struct {
+	transport http.RoundTripper
+	probeUrl  string
+	threshold int32
+	interval  time.Duration
+
+	failures int32
+	open     int32
+}
+
+func newCircuitBreaker(transport http.RoundTripper, baseUrl string, threshold int, interval time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		transport: transport,
+		probeUrl:  baseUrl + "/identity",
+		threshold: int32(threshold),
+		interval:  interval,
+	}
+}
+
+func (b *circuitBreaker) IsOpen() bool {
+	return b != nil && atomic.LoadInt32(&b.open) == 1
+}
+
+func (b *circuitBreaker) RoundTrip(r *http.Request) (*http.Response, error) {
+	if b.IsOpen() {
+		return nil, errUpstreamUnavailable
+	}
+	resp, err := b.transport.RoundTrip(r)
+	if err != nil {
+		if r.Context().Err() == nil && atomic.AddInt32(&b.failures, 1) >= b.threshold {
+			b.trip(err)
+		}
+		return nil, err
+	}
+	atomic.StoreInt32(&b.failures, 0)
+	return resp, nil
+}
+
+func (b *circuitBreaker) trip(err error) {
+	if !atomic.CompareAndSwapInt32(&b.open, 0, 1) {
+		return
+	}
+	common.GetLogger().Printf("Circuit opened, Plex Media Server seems to be down: %s", err.Error())
+	go b.probe()
+}
+
+func (b *circuitBreaker) probe() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if b.isUpstreamAlive() {
+			atomic.StoreInt32(&b.failures, 0)
+			atomic.StoreInt32(&b.open, 0)
+			common.GetLogger().Println("Circuit closed, Plex Media Server is back online")
+			return
+		}
+	}
+}
+
+func (b *circuitBreaker) isUpstreamAlive() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), b.interval)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.probeUrl, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := b.transport.RoundTrip(req)
+	if err != nil {
+		return false
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode < http.StatusInternalServerError
+}
@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/RoyXiang/plexproxy/common"
+)
+
+type ruleConfig struct {
+	Access         []*accessRule            `json:"access"`
+	Schedules      []*accessSchedule        `json:"schedules"`
+	HiddenSections []*sectionFilter         `json:"hidden_sections"`
+	Transcode      []*transcodeRule         `json:"transcode"`
+	Profiles       []*profileRule           `json:"profiles"`
+	Caps           []*transcodeCapRule      `json:"caps"`
+	Webhooks       []*webhookTarget         `json:"webhooks"`
+	Plaxt          map[string]string        `json:"plaxt"`
+	Music          map[string]*musicAccount `json:"music"`
+	Mqtt           []*mqttRule              `json:"mqtt"`
+	Notifications  []*notifyTarget          `json:"notifications"`
+	Watched        map[string]*watchedRule  `json:"watched"`
+}
+
+func loadRuleConfig(path string) (*ruleConfig, error) {
+	config := &ruleConfig{}
+	if path == "" {
+		return config, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, config); err != nil {
+		return nil, err
+	}
+	if err = config.init(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *ruleConfig) init() error {
+	for _, rule := range c.Access {
+		if err := rule.init(); err != nil {
+			return err
+		}
+	}
+	for _, schedule := range c.Schedules {
+		if err := schedule.init(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range c.Transcode {
+		if err := rule.init(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range c.Caps {
+		if err := rule.init(); err != nil {
+			return err
+		}
+	}
+	for _, target := range c.Webhooks {
+		if err := target.init(); err != nil {
+			return err
+		}
+	}
+	for sectionType, rule := range c.Watched {
+		if sectionType != "movie" && sectionType != "show" {
+			return fmt.Errorf("invalid library type of watched rule: %q", sectionType)
+		}
+		if err := rule.init(); err != nil {
+			return err
+		}
+	}
+	for _, target := range c.Notifications {
+		if err := target.init(); err != nil {
+			return err
+		}
+	}
+	for _, rule := range c.Mqtt {
+		if err := rule.init(); err != nil {
+			return err
+		}
+	}
+	for user, value := range c.Plaxt {
+		plaxtUrl := parsePlaxtUrl(value)
+		if plaxtUrl == "" {
+			return fmt.Errorf("invalid Plaxt URL of user %s: %q", user, value)
+		}
+		c.Plaxt[user] = plaxtUrl
+	}
+	return nil
+}
+
+func (c *PlexClient) getRules() *ruleConfig {
+	return c.rules.Load()
+}
+
+// watchRules reloads all sections of rules once the file is modified, until stop is closed
+func (c *PlexClient) watchRules(path string, interval time.Duration, stop <-chan struct{}) {
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(modTime) {
+			continue
+		}
+		modTime = info.ModTime()
+		_ = c.reloadRules()
+	}
+}
+
+func (c *PlexClient) reloadRules() error {
+	rules, err := loadRuleConfig(c.rulesFile)
+	if err != nil {
+		common.GetLogger().Printf("Failed to reload rules from %s: %s", c.rulesFile, err.Error())
+		return err
+	}
+	c.rules.Store(rules)
+	common.GetLogger().Printf("Rules reloaded from %s", c.rulesFile)
+	return nil
+}
+
+func (c *PlexClient) ReloadRules(w http.ResponseWriter, _ *http.Request) {
+	if c.rulesFile == "" {
+		http.Error(w, "RULES_FILE is not configured", http.StatusNotFound)
+		return
+	}
+	if err := c.reloadRules(); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,22 +1,31 @@
 package handler
 
+import "time"
+
 const (
 	headerPlexPrefix     = "X-Plex-"
 	headerCacheStatus    = "X-Plex-Cache-Status"
 	headerClientIdentity = "X-Plex-Client-Identifier"
+	headerDevice         = "X-Plex-Device"
+	headerDeviceName     = "X-Plex-Device-Name"
 	headerExtraProfile   = "X-Plex-Client-Profile-Extra"
+	headerModel          = "X-Plex-Model"
 	headerPageSize       = "X-Plex-Container-Size"
 	headerPageStart      = "X-Plex-Container-Start"
+	headerPlatform       = "X-Plex-Platform"
+	headerProduct        = "X-Plex-Product"
 	headerToken          = "X-Plex-Token"
 	headerUserId         = "X-Plex-User-Id"
 
 	headerAccept         = "Accept"
+	headerAcceptEncoding = "Accept-Encoding"
 	headerAcceptLanguage = "Accept-Language"
 	headerCacheControl   = "Cache-Control"
 	headerContentType    = "Content-Type"
 	headerRange          = "Range"
 	headerVary           = "Vary"
 	headerUpgrade        = "Upgrade"
+	headerWarning        = "Warning"
 
 	headerForwardedFor    = "X-Forwarded-For"
 	headerRealIP          = "X-Real-IP"
@@ -27,16 +36,27 @@ const (
 	cachePrefixStatic  = "static"
 	cachePrefixPlex    = "plex"
 
+	defaultTrustedProxies = "127.0.0.0/8,::1"
+
+	offlineCacheSize    = 1000
+	offlineCacheTtl     = time.Hour * 6
+	offlineCacheMaxBody = 1 << 20
+
 	contentTypeAny = "*/*"
 	contentTypeXml = "xml"
 
-	lockKeySections = "plex:library:sections"
-	lockKeySessions = "plex:playback:sessions"
-	lockKeyToken    = "plex:token"
-	lockKeyUsers    = "plex:users"
+	lockKeySections   = "plex:library:sections"
+	lockKeySessions   = "plex:playback:sessions"
+	lockKeyToken      = "plex:token"
+	lockKeyTranscodes = "plex:transcode:sessions"
+	lockKeyUsers      = "plex:users"
 
 	watchedThreshold = 90
 
+	userCacheTtl         = time.Hour
+	userInvalidTtl       = time.Minute * 5
+	usersRefreshInterval = time.Minute * 10
+
 	webhookEventPlay     = "media.play"
 	webhookEventResume   = "media.resume"
 	webhookEventPause    = "media.pause"
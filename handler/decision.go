@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RoyXiang/plexproxy/common"
+)
+
+const decisionHistorySize = 200
+
+type transcodeDecision struct {
+	Time                   time.Time `json:"time"`
+	Username               string    `json:"username"`
+	Device                 string    `json:"device"`
+	Product                string    `json:"product"`
+	RatingKey              string    `json:"rating_key"`
+	Decision               string    `json:"decision"`
+	GeneralDecisionCode    string    `json:"general_decision_code"`
+	GeneralDecisionText    string    `json:"general_decision_text"`
+	DirectPlayDecisionCode string    `json:"direct_play_decision_code"`
+	DirectPlayDecisionText string    `json:"direct_play_decision_text"`
+	TranscodeDecisionCode  string    `json:"transcode_decision_code"`
+	TranscodeDecisionText  string    `json:"transcode_decision_text"`
+}
+
+type decisionHistory struct {
+	mu      sync.RWMutex
+	records []*transcodeDecision
+	next    int
+}
+
+func newDecisionHistory(size int) *decisionHistory {
+	return &decisionHistory{
+		records: make([]*transcodeDecision, 0, size),
+	}
+}
+
+func (h *decisionHistory) Add(d *transcodeDecision) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.records) < cap(h.records) {
+		h.records = append(h.records, d)
+	} else {
+		h.records[h.next] = d
+	}
+	h.next = (h.next + 1) % cap(h.records)
+}
+
+// List returns the latest records first, which pass the filter
+func (h *decisionHistory) List(filter func(*transcodeDecision) bool, limit int) []*transcodeDecision {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	result := make([]*transcodeDecision, 0)
+	for i := 1; i <= len(h.records) && len(result) < limit; i++ {
+		d := h.records[(h.next-i+len(h.records))%len(h.records)]
+		if filter(d) {
+			result = append(result, d)
+		}
+	}
+	return result
+}
+
+func recordTranscodeDecision(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK || resp.Request.URL.EscapedPath() != "/video/:/transcode/universal/decision" {
+		return nil
+	}
+	user, ok := resp.Request.Context().Value(userCtxKey).(*plexUser)
+	if !ok {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get(headerContentType))
+	isJson := strings.HasSuffix(mediaType, "json")
+	if !isJson && !strings.HasSuffix(mediaType, "xml") {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	var container, part func(string) string
+	if isJson {
+		var root struct {
+			MediaContainer map[string]interface{} `json:"MediaContainer"`
+		}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err = decoder.Decode(&root); err != nil {
+			return nil
+		}
+		container = jsonAttr(root.MediaContainer)
+		part = jsonAttr(findJsonNode(root.MediaContainer, "Metadata", "Media", "Part"))
+	} else {
+		root := &xmlNode{}
+		if err = xml.Unmarshal(body, root); err != nil {
+			return nil
+		}
+		container, part = root.attr, jsonAttr(nil)
+		if node := findXmlNode(root, "", "Media", "Part"); node != nil {
+			part = node.attr
+		}
+	}
+
+	r := resp.Request
+	d := &transcodeDecision{
+		Time:                   time.Now(),
+		Username:               user.Username,
+		Device:                 r.Header.Get(headerClientIdentity),
+		Product:                r.Header.Get(headerProduct),
+		RatingKey:              path.Base(r.URL.Query().Get("path")),
+		Decision:               part("decision"),
+		GeneralDecisionCode:    container("generalDecisionCode"),
+		GeneralDecisionText:    container("generalDecisionText"),
+		DirectPlayDecisionCode: container("directPlayDecisionCode"),
+		DirectPlayDecisionText: container("directPlayDecisionText"),
+		TranscodeDecisionCode:  container("transcodeDecisionCode"),
+		TranscodeDecisionText:  container("transcodeDecisionText"),
+	}
+	plexClient.decisions.Add(d)
+	common.GetLogger().Printf("Playback decision %q for %s on %q (%s): direct play %s %q, transcode %s %q",
+		d.Decision, d.Username, d.Product, d.Device,
+		d.DirectPlayDecisionCode, d.DirectPlayDecisionText, d.TranscodeDecisionCode, d.TranscodeDecisionText)
+	return nil
+}
+
+func (c *PlexClient) ListTranscodeDecisions(w http.ResponseWriter, r *http.Request) {
+	username := r.FormValue("user")
+	device := r.FormValue("device")
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = decisionHistorySize
+	}
+	writeJson(w, c.decisions.List(func(d *transcodeDecision) bool {
+		return (username == "" || strings.EqualFold(d.Username, username)) && (device == "" || d.Device == device)
+	}, limit))
+}
+
+func jsonAttr(node map[string]interface{}) func(string) string {
+	return func(name string) string {
+		if value, ok := node[name]; ok && value != nil {
+			return fmt.Sprint(value)
+		}
+		return ""
+	}
+}
+
+// findJsonNode walks through the first element of each name in turn, e.g. the first part of the first media of the first
+// item
+func findJsonNode(node map[string]interface{}, names ...string) map[string]interface{} {
+	for _, name := range names {
+		items, ok := node[name].([]interface{})
+		if !ok || len(items) == 0 {
+			return nil
+		}
+		if node, ok = items[0].(map[string]interface{}); !ok {
+			return nil
+		}
+	}
+	return node
+}
+
+// findXmlNode walks through the first element of each name in turn like findJsonNode, an empty name matches elements of
+// any name, since items are named after their types in XML
+func findXmlNode(node *xmlNode, names ...string) *xmlNode {
+	for _, name := range names {
+		var found *xmlNode
+		for _, child := range node.Nodes {
+			if name == "" || child.XMLName.Local == name {
+				found = child
+				break
+			}
+		}
+		if found == nil {
+			return nil
+		}
+		node = found
+	}
+	return node
+}
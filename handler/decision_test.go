@@ -0,0 +1,46 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"testing"
+)
+
+func TestFindPart(t *testing.T) {
+	jsonBody := `{"MediaContainer": {"size": 1, "Metadata": [{"ratingKey": "1", "Media": [
+		{"id": 1, "Part": [{"id": 11, "decision": "directplay"}, {"id": 12, "decision": "transcode"}]},
+		{"id": 2, "Part": [{"id": 21, "decision": "transcode"}]}
+	]}]}}`
+	xmlBody := `<MediaContainer size="1"><Video ratingKey="1">
+		<Media id="1"><Part id="11" decision="directplay"/><Part id="12" decision="transcode"/></Media>
+		<Media id="2"><Part id="21" decision="transcode"/></Media>
+	</Video></MediaContainer>`
+
+	for i := 0; i < 10; i++ {
+		var root struct {
+			MediaContainer map[string]interface{} `json:"MediaContainer"`
+		}
+		decoder := json.NewDecoder(bytes.NewReader([]byte(jsonBody)))
+		decoder.UseNumber()
+		if err := decoder.Decode(&root); err != nil {
+			t.Fatal(err)
+		}
+		part := jsonAttr(findJsonNode(root.MediaContainer, "Metadata", "Media", "Part"))
+		if part("id") != "11" || part("decision") != "directplay" {
+			t.Fatalf("unexpected part in JSON: %s", part("id"))
+		}
+	}
+
+	root := &xmlNode{}
+	if err := xml.Unmarshal([]byte(xmlBody), root); err != nil {
+		t.Fatal(err)
+	}
+	part := findXmlNode(root, "", "Media", "Part")
+	if part == nil || part.attr("id") != "11" || part.attr("decision") != "directplay" {
+		t.Fatalf("unexpected part in XML: %+v", part)
+	}
+	if findXmlNode(root, "", "Stream") != nil {
+		t.Error("unexpected element in XML")
+	}
+}
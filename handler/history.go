@@ -0,0 +1,408 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RoyXiang/plexproxy/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	historyEventProgress    = "progress"
+	historyProgressInterval = time.Minute
+	historyDefaultLimit     = 100
+	historyMaxLimit         = 1000
+)
+
+var (
+	historyBucket      = []byte("history")
+	historyUsersBucket = []byte("history_users")
+	historyItemsBucket = []byte("history_items")
+)
+
+type historyRecord struct {
+	Time                 time.Time `json:"time"`
+	Event                string    `json:"event"`
+	UserId               int       `json:"user_id"`
+	Username             string    `json:"username"`
+	Type                 string    `json:"type"`
+	RatingKey            string    `json:"rating_key"`
+	ParentRatingKey      string    `json:"parent_rating_key,omitempty"`
+	GrandparentRatingKey string    `json:"grandparent_rating_key,omitempty"`
+	Title                string    `json:"title"`
+	GrandparentTitle     string    `json:"grandparent_title,omitempty"`
+	Season               int       `json:"season,omitempty"`
+	Episode              int       `json:"episode,omitempty"`
+	Year                 int       `json:"year,omitempty"`
+	Device               string    `json:"device"`
+	Player               string    `json:"player"`
+	Product              string    `json:"product"`
+	Ip                   string    `json:"ip"`
+	ViewOffset           int       `json:"view_offset"`
+	Duration             int       `json:"duration"`
+	Progress             int       `json:"progress"`
+	// WatchTime is the number of seconds played since the previous record of the same session
+	WatchTime int64 `json:"watch_time"`
+}
+
+type historyQuery struct {
+	User   string
+	Item   string
+	Device string
+	Event  string
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+type historyStats struct {
+	Records   int   `json:"records"`
+	Plays     int   `json:"plays"`
+	Scrobbles int   `json:"scrobbles"`
+	Items     int   `json:"items"`
+	WatchTime int64 `json:"watch_time"`
+}
+
+type historyUserStats struct {
+	UserId   int    `json:"user_id"`
+	Username string `json:"username"`
+	historyStats
+}
+
+type historyResponse struct {
+	Records []*historyRecord    `json:"records"`
+	Total   historyStats        `json:"total"`
+	Users   []*historyUserStats `json:"users"`
+}
+
+type historyStore struct {
+	db *bolt.DB
+}
+
+func newHistoryStore(path string) (*historyStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second * 5})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return err
+		}
+		if tx.Bucket(historyUsersBucket) != nil && tx.Bucket(historyItemsBucket) != nil {
+			return nil
+		}
+		// indexes are built from existing records once they are missing
+		_ = tx.DeleteBucket(historyUsersBucket)
+		_ = tx.DeleteBucket(historyItemsBucket)
+		if _, err = tx.CreateBucket(historyUsersBucket); err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucket(historyItemsBucket); err != nil {
+			return err
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var record historyRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return nil
+			}
+			return putHistoryIndexes(tx, k, &record)
+		})
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &historyStore{db: db}, nil
+}
+
+func (h *historyStore) Close() error {
+	return h.db.Close()
+}
+
+// Add stores the record with a key of its time and a sequence, so records are sorted by time, and indexes it by user and
+// item
+func (h *historyStore) Add(record *historyRecord) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return h.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := make([]byte, 16)
+		binary.BigEndian.PutUint64(key, uint64(record.Time.UnixNano()))
+		binary.BigEndian.PutUint64(key[8:], seq)
+		if err = bucket.Put(key, b); err != nil {
+			return err
+		}
+		return putHistoryIndexes(tx, key, record)
+	})
+}
+
+// putHistoryIndexes indexes the record by its user ID and username, and by rating keys of the item, its season and its
+// show. Index keys consist of the indexed value, a zero byte, and the key of the record, so entries of the same value
+// are sorted by time as well
+func putHistoryIndexes(tx *bolt.Tx, key []byte, record *historyRecord) error {
+	users := tx.Bucket(historyUsersBucket)
+	for _, value := range []string{strconv.Itoa(record.UserId), strings.ToLower(record.Username)} {
+		if value == "" {
+			continue
+		}
+		if err := users.Put(historyIndexKey(value, key), nil); err != nil {
+			return err
+		}
+	}
+	items := tx.Bucket(historyItemsBucket)
+	for _, value := range []string{record.RatingKey, record.ParentRatingKey, record.GrandparentRatingKey} {
+		if value == "" {
+			continue
+		}
+		if err := items.Put(historyIndexKey(value, key), nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func historyIndexKey(value string, key []byte) []byte {
+	indexKey := make([]byte, 0, len(value)+1+len(key))
+	indexKey = append(indexKey, value...)
+	indexKey = append(indexKey, 0)
+	return append(indexKey, key...)
+}
+
+// Query walks through records from the newest to the oldest within the date range, through the index of the item or
+// the user if either is queried, returns at most limit records along with aggregates of all matching ones
+func (h *historyStore) Query(q *historyQuery) (*historyResponse, error) {
+	resp := &historyResponse{
+		Records: make([]*historyRecord, 0),
+		Users:   make([]*historyUserStats, 0),
+	}
+	items := make(map[string]struct{})
+	users := make(map[int]*historyUserStats)
+	userItems := make(map[int]map[string]struct{})
+
+	lower, upper := make([]byte, 8), make([]byte, 8)
+	if !q.From.IsZero() {
+		binary.BigEndian.PutUint64(lower, uint64(q.From.UnixNano()))
+	}
+	if q.To.IsZero() {
+		binary.BigEndian.PutUint64(upper, math.MaxUint64)
+	} else {
+		binary.BigEndian.PutUint64(upper, uint64(q.To.UnixNano()))
+	}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket)
+		var (
+			cursor *bolt.Cursor
+			prefix []byte
+		)
+		switch {
+		case q.Item != "":
+			cursor, prefix = tx.Bucket(historyItemsBucket).Cursor(), historyIndexKey(q.Item, nil)
+		case q.User != "":
+			cursor, prefix = tx.Bucket(historyUsersBucket).Cursor(), historyIndexKey(strings.ToLower(q.User), nil)
+		default:
+			cursor = bucket.Cursor()
+		}
+
+		end := append(append([]byte{}, prefix...), upper...)
+		k, v := cursor.Seek(end)
+		if k == nil {
+			k, v = cursor.Last()
+		}
+		for k != nil && bytes.Compare(k, end) >= 0 {
+			k, v = cursor.Prev()
+		}
+		for ; k != nil && bytes.HasPrefix(k, prefix); k, v = cursor.Prev() {
+			key := k[len(prefix):]
+			if len(key) < 8 || bytes.Compare(key[:8], lower) < 0 {
+				break
+			}
+			if prefix != nil {
+				v = bucket.Get(key)
+			}
+			var record historyRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				continue
+			}
+			if !q.match(&record) {
+				continue
+			}
+			if len(resp.Records) < q.Limit {
+				resp.Records = append(resp.Records, &record)
+			}
+
+			stats, ok := users[record.UserId]
+			if !ok {
+				stats = &historyUserStats{
+					UserId:   record.UserId,
+					Username: record.Username,
+				}
+				users[record.UserId] = stats
+				userItems[record.UserId] = make(map[string]struct{})
+			}
+			resp.Total.add(&record)
+			stats.add(&record)
+			items[record.RatingKey] = emptyStruct
+			userItems[record.UserId][record.RatingKey] = emptyStruct
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Total.Items = len(items)
+	for id, stats := range users {
+		stats.Items = len(userItems[id])
+		resp.Users = append(resp.Users, stats)
+	}
+	sort.Slice(resp.Users, func(i, j int) bool {
+		return resp.Users[i].WatchTime > resp.Users[j].WatchTime
+	})
+	return resp, nil
+}
+
+func (s *historyStats) add(record *historyRecord) {
+	s.Records++
+	s.WatchTime += record.WatchTime
+	switch record.Event {
+	case "play":
+		s.Plays++
+	case "scrobble":
+		s.Scrobbles++
+	}
+}
+
+func (q *historyQuery) match(record *historyRecord) bool {
+	if q.User != "" && q.User != strconv.Itoa(record.UserId) && !strings.EqualFold(q.User, record.Username) {
+		return false
+	}
+	if q.Item != "" && q.Item != record.RatingKey && q.Item != record.ParentRatingKey && q.Item != record.GrandparentRatingKey {
+		return false
+	}
+	if q.Device != "" && q.Device != record.Device {
+		return false
+	}
+	if q.Event != "" && q.Event != record.Event {
+		return false
+	}
+	return true
+}
+
+// recordHistory stores the event of the session, the watch time is counted only if it was being played
+func (c *PlexClient) recordHistory(r *http.Request, user *plexUser, session *sessionData, previous sessionStatus, sectionType, event string, viewOffset int) {
+	now := time.Now()
+	m := session.metadata
+	record := &historyRecord{
+		Time:       now,
+		Event:      strings.TrimPrefix(event, "media."),
+		UserId:     user.Id,
+		Username:   user.Username,
+		Type:       "movie",
+		RatingKey:  m.RatingKey,
+		Title:      m.Title,
+		Year:       m.Year,
+		Device:     m.Player.MachineIdentifier,
+		Player:     m.Player.Title,
+		Product:    m.Player.Product,
+		Ip:         getClientIP(r),
+		ViewOffset: viewOffset,
+		Duration:   m.Duration,
+		Progress:   session.progress,
+	}
+	if sectionType == "show" {
+		record.Type = "episode"
+		record.ParentRatingKey = m.ParentRatingKey
+		record.GrandparentRatingKey = m.GrandparentRatingKey
+		record.GrandparentTitle = m.GrandparentTitle
+		record.Season = int(m.ParentIndex)
+		record.Episode = int(m.Index)
+	}
+	if previous == sessionPlaying && !session.historyAt.IsZero() {
+		record.WatchTime = int64(now.Sub(session.historyAt) / time.Second)
+	}
+	session.historyAt = now
+
+	if err := c.history.Add(record); err != nil {
+		common.GetLogger().Printf("Failed to record history: %s", err.Error())
+	}
+}
+
+func (c *PlexClient) ListHistory(w http.ResponseWriter, r *http.Request) {
+	c.queryHistory(w, r, r.URL.Query().Get("user"))
+}
+
+// ListUserHistory lists history of the current user only
+func (c *PlexClient) ListUserHistory(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userCtxKey).(*plexUser)
+	c.queryHistory(w, r, strconv.Itoa(user.Id))
+}
+
+func (c *PlexClient) queryHistory(w http.ResponseWriter, r *http.Request, user string) {
+	params := r.URL.Query()
+	q := &historyQuery{
+		User:   user,
+		Item:   params.Get("item"),
+		Device: params.Get("device"),
+		Event:  params.Get("event"),
+		Limit:  historyDefaultLimit,
+	}
+	var err error
+	if q.From, err = parseHistoryTime(params.Get("from"), false); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if q.To, err = parseHistoryTime(params.Get("to"), true); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 0 {
+			http.Error(w, fmt.Sprintf("invalid limit: %q", limit), http.StatusBadRequest)
+			return
+		} else if q.Limit > historyMaxLimit {
+			q.Limit = historyMaxLimit
+		}
+	}
+
+	resp, err := c.history.Query(q)
+	if err != nil {
+		common.GetLogger().Printf("Failed to query history: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, resp)
+}
+
+// parseHistoryTime accepts RFC 3339 timestamps or dates, a date as the upper bound includes the whole day
+func parseHistoryTime(value string, upper bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time: %q", value)
+	}
+	if upper {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestHistoryStore(t *testing.T) (*historyStore, string) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	h, err := newHistoryStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := []*historyRecord{
+		{UserId: 1, Username: "Alice", RatingKey: "10", ParentRatingKey: "2", GrandparentRatingKey: "1"},
+		{UserId: 2, Username: "Bob", RatingKey: "20"},
+		{UserId: 1, Username: "Alice", RatingKey: "11", ParentRatingKey: "2", GrandparentRatingKey: "1"},
+		{UserId: 12, Username: "Carol", RatingKey: "10", ParentRatingKey: "2", GrandparentRatingKey: "1"},
+		{UserId: 1, Username: "Alice", RatingKey: "20"},
+	}
+	for i, record := range records {
+		record.Time = base.Add(time.Hour * time.Duration(i))
+		record.Event = "play"
+		if err = h.Add(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return h, path
+}
+
+func checkHistory(t *testing.T, h *historyStore, q *historyQuery, expected ...string) {
+	t.Helper()
+	if q.Limit == 0 {
+		q.Limit = historyDefaultLimit
+	}
+	resp, err := h.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Records) != len(expected) || resp.Total.Records != len(expected) {
+		t.Fatalf("expected %d records, got %d", len(expected), len(resp.Records))
+	}
+	for i, record := range resp.Records {
+		if key := record.Username + "/" + record.RatingKey; key != expected[i] {
+			t.Errorf("expected %s at %d, got %s", expected[i], i, key)
+		}
+	}
+}
+
+func TestHistoryQuery(t *testing.T) {
+	h, _ := newTestHistoryStore(t)
+	defer h.Close()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	checkHistory(t, h, &historyQuery{}, "Alice/20", "Carol/10", "Alice/11", "Bob/20", "Alice/10")
+	checkHistory(t, h, &historyQuery{User: "1"}, "Alice/20", "Alice/11", "Alice/10")
+	checkHistory(t, h, &historyQuery{User: "alice"}, "Alice/20", "Alice/11", "Alice/10")
+	checkHistory(t, h, &historyQuery{Item: "1"}, "Carol/10", "Alice/11", "Alice/10")
+	checkHistory(t, h, &historyQuery{Item: "10", User: "12"}, "Carol/10")
+	checkHistory(t, h, &historyQuery{From: base.Add(time.Hour), To: base.Add(time.Hour * 3)}, "Alice/11", "Bob/20")
+	checkHistory(t, h, &historyQuery{User: "1", From: base.Add(time.Hour), To: base.Add(time.Hour * 4)}, "Alice/11")
+	checkHistory(t, h, &historyQuery{Item: "20", To: base.Add(time.Hour * 4)}, "Bob/20")
+	checkHistory(t, h, &historyQuery{User: "3"})
+}
+
+func TestHistoryIndexesBuilt(t *testing.T) {
+	h, path := newTestHistoryStore(t)
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		return tx.DeleteBucket(historyUsersBucket)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = h.Close()
+
+	if h, err = newHistoryStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	checkHistory(t, h, &historyQuery{User: "bob"}, "Bob/20")
+	checkHistory(t, h, &historyQuery{Item: "2"}, "Carol/10", "Alice/11", "Alice/10")
+}
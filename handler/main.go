@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"expvar"
 	"log"
 	"net/http"
 	"os"
@@ -17,27 +18,97 @@ var (
 
 func init() {
 	plexClient = NewPlexClient(PlexConfig{
-		BaseUrl:          os.Getenv("PLEX_BASEURL"),
-		Token:            os.Getenv("PLEX_TOKEN"),
-		PlaxtUrl:         os.Getenv("PLAXT_URL"),
-		StaticCacheSize:  os.Getenv("STATIC_CACHE_SIZE"),
-		StaticCacheTtl:   os.Getenv("STATIC_CACHE_TTL"),
-		RedirectWebApp:   os.Getenv("REDIRECT_WEB_APP"),
-		DisableTranscode: os.Getenv("DISABLE_TRANSCODE"),
-		NoRequestLogs:    os.Getenv("NO_REQUEST_LOGS"),
+		BaseUrl:           os.Getenv("PLEX_BASEURL"),
+		Token:             os.Getenv("PLEX_TOKEN"),
+		PlaxtUrl:          os.Getenv("PLAXT_URL"),
+		StaticCacheSize:   os.Getenv("STATIC_CACHE_SIZE"),
+		StaticCacheTtl:    os.Getenv("STATIC_CACHE_TTL"),
+		RedirectWebApp:    os.Getenv("REDIRECT_WEB_APP"),
+		DisableTranscode:  os.Getenv("DISABLE_TRANSCODE"),
+		NoRequestLogs:     os.Getenv("NO_REQUEST_LOGS"),
+		BreakerThreshold:  os.Getenv("CIRCUIT_BREAKER_THRESHOLD"),
+		BreakerInterval:   os.Getenv("CIRCUIT_BREAKER_INTERVAL"),
+		RulesFile:         os.Getenv("RULES_FILE"),
+		RulesPollInterval: os.Getenv("RULES_POLL_INTERVAL"),
+		AuditLog:          os.Getenv("AUDIT_LOG"),
+		AuditLogMaxSize:   os.Getenv("AUDIT_LOG_MAX_SIZE"),
+		AuditLogBackups:   os.Getenv("AUDIT_LOG_BACKUPS"),
+		TranscodeQuota:    os.Getenv("TRANSCODE_QUOTA"),
+		TraktClientId:     os.Getenv("TRAKT_CLIENT_ID"),
+		TraktClientSecret: os.Getenv("TRAKT_CLIENT_SECRET"),
+		TraktApiUrl:       os.Getenv("TRAKT_API_URL"),
+		TraktTokenFile:    os.Getenv("TRAKT_TOKEN_FILE"),
+		ListenBrainzUrl:   os.Getenv("LISTENBRAINZ_API_URL"),
+		LastfmUrl:         os.Getenv("LASTFM_API_URL"),
+		LastfmApiKey:      os.Getenv("LASTFM_API_KEY"),
+		LastfmApiSecret:   os.Getenv("LASTFM_API_SECRET"),
+		WebhookQueueFile:  os.Getenv("WEBHOOK_QUEUE_FILE"),
+		WebhookSecret:     os.Getenv("WEBHOOK_SECRET"),
+		HistoryFile:       os.Getenv("HISTORY_DB"),
+		MqttBroker:        os.Getenv("MQTT_BROKER"),
+		MqttClientId:      os.Getenv("MQTT_CLIENT_ID"),
+		MqttUsername:      os.Getenv("MQTT_USERNAME"),
+		MqttPassword:      os.Getenv("MQTT_PASSWORD"),
+		MqttTopic:         os.Getenv("MQTT_TOPIC"),
+		MqttQos:           os.Getenv("MQTT_QOS"),
+		MqttRetain:        os.Getenv("MQTT_RETAIN"),
+		KnownDevicesFile:  os.Getenv("KNOWN_DEVICES_FILE"),
+		SessionsFile:      os.Getenv("SESSIONS_FILE"),
+		TrustedProxies:    os.Getenv("TRUSTED_PROXIES"),
 	})
-	if plexClient == nil {
-		log.Fatalln("Please configure PLEX_BASEURL as a valid URL at first")
+}
+
+// Shutdown saves states which should survive restarts
+func Shutdown() {
+	if plexClient.rulesStop != nil {
+		close(plexClient.rulesStop)
+	}
+	plexClient.saveSessions()
+	if plexClient.history != nil {
+		_ = plexClient.history.Close()
 	}
 }
 
 func NewRouter() http.Handler {
+	if plexClient == nil {
+		log.Fatalln("Please configure PLEX_BASEURL as a valid URL at first")
+	}
+
 	r := mux.NewRouter()
 	r.Use(normalizeMiddleware)
 	if !plexClient.NoRequestLogs {
 		r.Use(middleware.Logger)
 	}
-	r.Use(wrapMiddleware, middleware.Recoverer, trafficMiddleware)
+	r.Use(wrapMiddleware)
+	if plexClient.auditLog != nil {
+		r.Use(auditMiddleware)
+	}
+	r.Use(accessMiddleware, middleware.Recoverer, trafficMiddleware)
+
+	userRouter := r.PathPrefix("/proxy/user/").Subrouter()
+	userRouter.Use(userMiddleware)
+	if plexClient.trakt != nil {
+		userRouter.Path("/trakt").Methods(http.MethodGet).HandlerFunc(plexClient.GetTraktStatus)
+		userRouter.Path("/trakt").Methods(http.MethodPost).HandlerFunc(plexClient.AuthorizeTrakt)
+		userRouter.Path("/trakt").Methods(http.MethodDelete).HandlerFunc(plexClient.UnlinkTrakt)
+	}
+	if plexClient.history != nil {
+		userRouter.Path("/history").Methods(http.MethodGet).HandlerFunc(plexClient.ListUserHistory)
+	}
+
+	adminRouter := r.PathPrefix("/proxy/").Subrouter()
+	adminRouter.Use(adminMiddleware)
+	adminRouter.Path("/metrics").Methods(http.MethodGet).Handler(expvar.Handler())
+	adminRouter.Path("/transcode/decisions").Methods(http.MethodGet).HandlerFunc(plexClient.ListTranscodeDecisions)
+	adminRouter.Path("/rules/reload").Methods(http.MethodPost).HandlerFunc(plexClient.ReloadRules)
+	if plexClient.webhookQueue != nil {
+		adminRouter.Path("/webhooks/queue").Methods(http.MethodGet).HandlerFunc(plexClient.ListWebhookQueue)
+		adminRouter.Path("/webhooks/queue/{id}").Methods(http.MethodDelete).HandlerFunc(plexClient.RemoveFromWebhookQueue)
+	}
+	if plexClient.history != nil {
+		adminRouter.Path("/history").Methods(http.MethodGet).HandlerFunc(plexClient.ListHistory)
+	}
+	adminRouter.Path("/sessions/terminate").Methods(http.MethodPost).HandlerFunc(plexClient.TerminateSessions)
 
 	staticRouter := r.Methods(http.MethodGet).Subrouter()
 	staticRouter.Use(staticMiddleware)
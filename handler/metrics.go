@@ -0,0 +1,10 @@
+package handler
+
+import (
+	"expvar"
+)
+
+var (
+	metricActiveTranscodes   = expvar.NewInt("active_transcodes")
+	metricTranscodeQuotaHits = expvar.NewInt("transcode_quota_hits")
+)
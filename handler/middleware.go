@@ -17,6 +17,7 @@ import (
 
 	"github.com/RoyXiang/plexproxy/common"
 	"github.com/bluele/gcache"
+	"github.com/go-chi/chi/v5/middleware"
 )
 
 var (
@@ -71,7 +72,12 @@ func normalizeMiddleware(next http.Handler) http.Handler {
 			}
 		}
 
-		next.ServeHTTP(w, cloneRequest(r, headers, params))
+		nr := cloneRequest(r, headers, params)
+		// forwarding headers are still passed through to Plex, they are only trusted here when set by known proxies
+		if ip := getForwardedIP(r, plexClient.trustedProxies); ip != "" {
+			nr.RemoteAddr = ip
+		}
+		next.ServeHTTP(w, nr)
 	})
 }
 
@@ -90,6 +96,85 @@ func wrapMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+
+		record := auditRecord{
+			Time:        start,
+			Device:      r.Header.Get(headerClientIdentity),
+			Product:     r.Header.Get(headerProduct),
+			IP:          getClientIP(r),
+			Method:      r.Method,
+			Path:        r.URL.EscapedPath(),
+			RatingKey:   r.URL.Query().Get("ratingKey"),
+			Status:      http.StatusOK,
+			CacheStatus: w.Header().Get(headerCacheStatus),
+		}
+		if user, ok := r.Context().Value(userCtxKey).(*plexUser); ok {
+			record.Username = user.Username
+			record.UserId = user.Id
+		}
+		if ww, ok := w.(middleware.WrapResponseWriter); ok {
+			if status := ww.Status(); status > 0 {
+				record.Status = status
+			}
+			record.Bytes = ww.BytesWritten()
+		}
+		plexClient.WriteAuditRecord(&record)
+	})
+}
+
+func accessMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ar := newAccessRequest(r)
+		if plexClient.IsBanned(ar) {
+			common.GetLogger().Printf("Access denied to %s for a ban (%s)", r.URL.EscapedPath(), ar)
+			writePlexError(w, http.StatusForbidden)
+			return
+		} else if !plexClient.IsAccessAllowed(ar) {
+			common.GetLogger().Printf("Access denied to %s (%s)", r.URL.EscapedPath(), ar)
+			if ar.user == nil {
+				writePlexError(w, http.StatusUnauthorized)
+			} else {
+				writePlexError(w, http.StatusForbidden)
+			}
+			return
+		}
+		if ar.user != nil && !plexClient.CheckSchedule(ar.user, ar.device, time.Now()) {
+			common.GetLogger().Printf("Access denied to %s outside of schedule (%s)", r.URL.EscapedPath(), ar)
+			writePlexError(w, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func userMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(userCtxKey).(*plexUser); !ok {
+			writePlexError(w, http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := r.Context().Value(userCtxKey).(*plexUser)
+		if !ok {
+			writePlexError(w, http.StatusUnauthorized)
+			return
+		} else if !plexClient.IsOwner(user) {
+			writePlexError(w, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func trafficMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		params := r.URL.Query()
@@ -145,6 +230,19 @@ func dynamicMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// isOfflineCacheable reports whether the response is worth serving while Plex is unreachable, media, progress reports
+// and large responses are not kept
+func isOfflineCacheable(r *http.Request, size int) bool {
+	if size > offlineCacheMaxBody {
+		return false
+	}
+	path := r.URL.EscapedPath()
+	if strings.HasPrefix(path, "/:/") || strings.HasPrefix(path, "/library/parts/") || strings.Contains(path, "/transcode") {
+		return false
+	}
+	return true
+}
+
 func cacheMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ctxValue := r.Context().Value(cacheInfoCtxKey)
@@ -163,9 +261,16 @@ func cacheMiddleware(next http.Handler) http.Handler {
 				return
 			}
 			var resp *http.Response
+			cacheStatus := "HIT"
 			if cacheVal, err := cache.Get(cacheKey); err == nil {
 				reader := bufio.NewReader(bytes.NewReader(cacheVal.([]byte)))
 				resp, _ = http.ReadResponse(reader, r)
+			} else if plexClient.breaker.IsOpen() {
+				if cacheVal, err = plexClient.offlineCache.Get(cacheKey); err == nil {
+					reader := bufio.NewReader(bytes.NewReader(cacheVal.([]byte)))
+					resp, _ = http.ReadResponse(reader, r)
+					cacheStatus = "STALE"
+				}
 			}
 			if resp == nil {
 				nw := wrapResponseWriter(httptest.NewRecorder(), r.ProtoMajor)
@@ -180,11 +285,18 @@ func cacheMiddleware(next http.Handler) http.Handler {
 					}
 					if b, err := httputil.DumpResponse(resp, true); err == nil {
 						cache.Set(cacheKey, b)
+						if info.Prefix == cachePrefixDynamic && isOfflineCacheable(r, len(b)) {
+							plexClient.offlineCache.Set(cacheKey, b)
+						}
 					}
 				}()
 			} else {
 				defer func() {
-					w.Header().Set(headerCacheStatus, "HIT")
+					w.Header().Set(headerCacheStatus, cacheStatus)
+					if cacheStatus == "STALE" {
+						// tell clients that it is an offline fallback rather than live data
+						w.Header().Set(headerWarning, `110 - "Response is Stale"`)
+					}
 					w.WriteHeader(resp.StatusCode)
 					_, _ = io.Copy(w, resp.Body)
 				}()
@@ -199,6 +311,11 @@ func cacheMiddleware(next http.Handler) http.Handler {
 			if plexClient.staticCache == nil {
 				return
 			}
+			if user := r.Context().Value(userCtxKey); user != nil {
+				if hidden := plexClient.getHiddenSectionsKey(user.(*plexUser)); hidden != "" {
+					params.Set("hiddenSections", hidden)
+				}
+			}
 			cache = plexClient.staticCache
 		case cachePrefixDynamic:
 			if user := r.Context().Value(userCtxKey); user != nil {
@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RoyXiang/plexproxy/common"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/xanderstrike/plexhooks"
+)
+
+const (
+	mqttDefaultTopic      = "plexproxy/{user}/{player}"
+	mqttMaxReconnectDelay = time.Minute
+	mqttPublishTimeout    = time.Second * 10
+)
+
+var mqttTopicReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+type mqttRule struct {
+	Users   []string `json:"users"`
+	Players []string `json:"players"`
+	Events  []string `json:"events"`
+	Topic   string   `json:"topic"`
+	Qos     *byte    `json:"qos"`
+	Retain  *bool    `json:"retain"`
+}
+
+type mqttPublisher struct {
+	client mqtt.Client
+	topic  string
+	qos    byte
+	retain bool
+}
+
+func (rule *mqttRule) init() error {
+	if rule.Topic == "" {
+		return fmt.Errorf("topic of MQTT rule is required")
+	}
+	if rule.Qos != nil && *rule.Qos > 2 {
+		return fmt.Errorf("invalid MQTT QoS: %d", *rule.Qos)
+	}
+	for _, event := range rule.Events {
+		switch event {
+		case "play", "pause", "resume", "stop", "scrobble":
+		default:
+			return fmt.Errorf("invalid MQTT event: %q", event)
+		}
+	}
+	return nil
+}
+
+// match checks the event, the user, and the player by its client identifier or title
+func (rule *mqttRule) match(event string, user *plexUser, player *plexhooks.Player) bool {
+	if len(rule.Events) > 0 && !containsFold(rule.Events, strings.TrimPrefix(event, "media.")) {
+		return false
+	}
+	if len(rule.Users) > 0 && !matchUser(rule.Users, user) {
+		return false
+	}
+	if len(rule.Players) > 0 && !containsFold(rule.Players, player.Uuid) && !containsFold(rule.Players, player.Title) {
+		return false
+	}
+	return true
+}
+
+func newMqttPublisher(broker, clientId, username, password, topic, qos, retain string) (*mqttPublisher, error) {
+	p := &mqttPublisher{
+		topic: topic,
+	}
+	if p.topic == "" {
+		p.topic = mqttDefaultTopic
+	}
+	if qos != "" {
+		value, err := strconv.ParseUint(qos, 10, 8)
+		if err != nil || value > 2 {
+			return nil, fmt.Errorf("invalid MQTT QoS: %q", qos)
+		}
+		p.qos = byte(value)
+	}
+	if b, err := strconv.ParseBool(retain); err == nil {
+		p.retain = b
+	}
+	if clientId == "" {
+		clientId = "plexproxy"
+	}
+
+	options := mqtt.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientId).
+		SetUsername(username).
+		SetPassword(password).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(mqttMaxReconnectDelay).
+		SetConnectTimeout(time.Second * 10).
+		SetOnConnectHandler(func(_ mqtt.Client) {
+			common.GetLogger().Printf("Connected to MQTT broker %s", broker)
+		}).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			common.GetLogger().Printf("Lost connection to MQTT broker %s: %s", broker, err.Error())
+		})
+	p.client = mqtt.NewClient(options)
+	go p.connect(broker)
+	return p, nil
+}
+
+// connect retries with exponential backoff until the first connection is established, the client reconnects by
+// itself afterwards
+func (p *mqttPublisher) connect(broker string) {
+	delay := time.Second
+	for {
+		token := p.client.Connect()
+		if token.Wait() && token.Error() == nil {
+			return
+		}
+		common.GetLogger().Printf("Failed to connect to MQTT broker %s: %s", broker, token.Error())
+		time.Sleep(delay)
+		if delay *= 2; delay > mqttMaxReconnectDelay {
+			delay = mqttMaxReconnectDelay
+		}
+	}
+}
+
+func (p *mqttPublisher) Publish(topic string, qos byte, retain bool, payload []byte) {
+	token := p.client.Publish(topic, qos, retain, payload)
+	go func() {
+		if !token.WaitTimeout(mqttPublishTimeout) {
+			common.GetLogger().Printf("Timed out on publishing MQTT message to %s", topic)
+		} else if err := token.Error(); err != nil {
+			common.GetLogger().Printf("Failed on publishing MQTT message to %s: %s", topic, err.Error())
+		}
+	}()
+}
+
+// publishMqtt publishes the playback event to topics of every matching rule, or to MQTT_TOPIC if there is no rule
+func (c *PlexClient) publishMqtt(user *plexUser, webhook *plexhooks.PlexResponse, showGuids []plexhooks.ExternalGuid) {
+	payload, err := json.Marshal(newSimpleWebhook(user, webhook, showGuids))
+	if err != nil {
+		return
+	}
+	rules := c.getRules().Mqtt
+	if len(rules) == 0 {
+		c.mqtt.Publish(formatMqttTopic(c.mqtt.topic, user, webhook), c.mqtt.qos, c.mqtt.retain, payload)
+		return
+	}
+	for _, rule := range rules {
+		if !rule.match(webhook.Event, user, &webhook.Player) {
+			continue
+		}
+		qos, retain := c.mqtt.qos, c.mqtt.retain
+		if rule.Qos != nil {
+			qos = *rule.Qos
+		}
+		if rule.Retain != nil {
+			retain = *rule.Retain
+		}
+		c.mqtt.Publish(formatMqttTopic(rule.Topic, user, webhook), qos, retain, payload)
+	}
+}
+
+// formatMqttTopic replaces placeholders in the topic, wildcards and separators in their values are replaced with "_"
+func formatMqttTopic(topic string, user *plexUser, webhook *plexhooks.PlexResponse) string {
+	return strings.NewReplacer(
+		"{user}", mqttTopicReplacer.Replace(user.Username),
+		"{user_id}", strconv.Itoa(user.Id),
+		"{player}", mqttTopicReplacer.Replace(webhook.Player.Title),
+		"{player_id}", mqttTopicReplacer.Replace(webhook.Player.Uuid),
+		"{event}", strings.TrimPrefix(webhook.Event, "media."),
+	).Replace(topic)
+}
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/xanderstrike/plexhooks"
+)
+
+// serveMqtt accepts a single client, acknowledges its connection, and forwards messages it publishes
+func serveMqtt(t *testing.T) (string, <-chan *packets.PublishPacket) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	messages := make(chan *packets.PublishPacket, 10)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			packet, err := packets.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			switch p := packet.(type) {
+			case *packets.ConnectPacket:
+				ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+				_ = ack.Write(conn)
+			case *packets.PingreqPacket:
+				_ = packets.NewControlPacket(packets.Pingresp).Write(conn)
+			case *packets.PublishPacket:
+				messages <- p
+			case *packets.DisconnectPacket:
+				return
+			}
+		}
+	}()
+	return "tcp://" + listener.Addr().String(), messages
+}
+
+func TestMqttPublish(t *testing.T) {
+	broker, messages := serveMqtt(t)
+	publisher, err := newMqttPublisher(broker, "test", "", "", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.client.Disconnect(0)
+	for deadline := time.Now().Add(time.Second * 5); !publisher.client.IsConnected(); time.Sleep(time.Millisecond * 10) {
+		if time.Now().After(deadline) {
+			t.Fatal("not connected to the broker")
+		}
+	}
+
+	c := &PlexClient{mqtt: publisher}
+	retain := true
+	rules := &ruleConfig{
+		Mqtt: []*mqttRule{
+			{Events: []string{"stop"}, Topic: "ignored"},
+			{Users: []string{"bob"}, Topic: "plex/{user}/{player}/{event}", Retain: &retain},
+		},
+	}
+	if err = rules.init(); err != nil {
+		t.Fatal(err)
+	}
+	c.rules.Store(rules)
+
+	webhook := &plexhooks.PlexResponse{
+		Event:  webhookEventPlay,
+		Player: plexhooks.Player{Title: "Living/Room", Uuid: "player"},
+		Metadata: plexhooks.Metadata{
+			LibrarySectionType: "movie",
+			RatingKey:          "10",
+			Title:              "Movie",
+		},
+	}
+	c.publishMqtt(&plexUser{Id: 1, Username: "Bob"}, webhook, nil)
+
+	select {
+	case message := <-messages:
+		if message.TopicName != "plex/Bob/Living_Room/play" {
+			t.Errorf("unexpected topic: %q", message.TopicName)
+		}
+		if !message.Retain {
+			t.Error("message is not retained")
+		}
+		var payload simpleWebhook
+		if err = json.Unmarshal(message.Payload, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Event != "play" || payload.User.Username != "Bob" || payload.Item.RatingKey != "10" {
+			t.Errorf("unexpected payload: %s", message.Payload)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no message is published")
+	}
+	select {
+	case message := <-messages:
+		t.Errorf("unexpected message to %q", message.TopicName)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
@@ -0,0 +1,228 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RoyXiang/plexproxy/common"
+)
+
+const (
+	// tracks shorter than 30 seconds are never scrobbled, others are scrobbled once played up to half of their
+	// durations, or up to 4 minutes for long ones
+	listenMinDuration = 30 * 1000
+	listenMaxOffset   = 4 * 60 * 1000
+)
+
+type musicAccount struct {
+	ListenBrainzToken string `json:"listenbrainz_token"`
+	LastfmSessionKey  string `json:"lastfm_session_key"`
+}
+
+type musicTrack struct {
+	Artist    string
+	Album     string
+	Title     string
+	Duration  int
+	StartedAt time.Time
+}
+
+type musicClient struct {
+	listenBrainzUrl string
+	lastfmUrl       string
+	lastfmApiKey    string
+	lastfmApiSecret string
+	httpClient      *http.Client
+}
+
+func newMusicClient(listenBrainzUrl, lastfmUrl, lastfmApiKey, lastfmApiSecret string) *musicClient {
+	if listenBrainzUrl == "" {
+		listenBrainzUrl = "https://api.listenbrainz.org"
+	}
+	if lastfmUrl == "" {
+		lastfmUrl = "https://ws.audioscrobbler.com/2.0/"
+	}
+	return &musicClient{
+		listenBrainzUrl: strings.TrimSuffix(listenBrainzUrl, "/"),
+		lastfmUrl:       lastfmUrl,
+		lastfmApiKey:    lastfmApiKey,
+		lastfmApiSecret: lastfmApiSecret,
+		httpClient:      &http.Client{Timeout: time.Second * 30},
+	}
+}
+
+func (c *PlexClient) getMusicAccount(user *plexUser) *musicAccount {
+	accounts := c.getRules().Music
+	if account, ok := accounts[strconv.Itoa(user.Id)]; ok {
+		return account
+	}
+	for name, account := range accounts {
+		if strings.EqualFold(name, user.Username) {
+			return account
+		}
+	}
+	return nil
+}
+
+// scrobbleTrack sends now playing notifications once a track starts, and submits a listen once it has been played long enough,
+// requests are sent in the background so that the session is not locked while waiting for them
+func (c *PlexClient) scrobbleTrack(user *plexUser, session *sessionData, state string, viewOffset int) {
+	account := c.getMusicAccount(user)
+	if account == nil {
+		return
+	}
+	m := session.metadata
+	track := &musicTrack{
+		Artist:    m.OriginalTitle,
+		Album:     m.ParentTitle,
+		Title:     m.Title,
+		Duration:  m.Duration,
+		StartedAt: time.Now().Add(-time.Duration(viewOffset) * time.Millisecond),
+	}
+	if track.Artist == "" {
+		track.Artist = m.GrandparentTitle
+	}
+
+	switch state {
+	case "playing":
+		if session.status != sessionPlaying {
+			session.status = sessionPlaying
+			go c.music.NowPlaying(account, track)
+		}
+	case "paused":
+		session.status = sessionPaused
+	case "stopped":
+		session.status = sessionStopped
+	default:
+		return
+	}
+	threshold := track.Duration / 2
+	if threshold > listenMaxOffset {
+		threshold = listenMaxOffset
+	}
+	if track.Duration > listenMinDuration && viewOffset >= threshold {
+		go c.music.Listen(account, track)
+		session.status = sessionWatched
+	}
+}
+
+func (mc *musicClient) NowPlaying(account *musicAccount, track *musicTrack) {
+	if account.ListenBrainzToken != "" {
+		if err := mc.submitListenBrainz(account.ListenBrainzToken, "playing_now", track); err != nil {
+			common.GetLogger().Printf("Failed on sending now playing to ListenBrainz: %s", err.Error())
+		}
+	}
+	if account.LastfmSessionKey != "" && mc.lastfmApiKey != "" {
+		if err := mc.callLastfm("track.updateNowPlaying", account.LastfmSessionKey, track); err != nil {
+			common.GetLogger().Printf("Failed on sending now playing to Last.fm: %s", err.Error())
+		}
+	}
+}
+
+func (mc *musicClient) Listen(account *musicAccount, track *musicTrack) {
+	if account.ListenBrainzToken != "" {
+		if err := mc.submitListenBrainz(account.ListenBrainzToken, "single", track); err != nil {
+			common.GetLogger().Printf("Failed on submitting listen to ListenBrainz: %s", err.Error())
+		}
+	}
+	if account.LastfmSessionKey != "" && mc.lastfmApiKey != "" {
+		if err := mc.callLastfm("track.scrobble", account.LastfmSessionKey, track); err != nil {
+			common.GetLogger().Printf("Failed on scrobbling to Last.fm: %s", err.Error())
+		}
+	}
+}
+
+func (mc *musicClient) submitListenBrainz(token, listenType string, track *musicTrack) error {
+	listen := map[string]interface{}{
+		"track_metadata": map[string]interface{}{
+			"artist_name":  track.Artist,
+			"track_name":   track.Title,
+			"release_name": track.Album,
+			"additional_info": map[string]interface{}{
+				"duration_ms":       track.Duration,
+				"media_player":      "Plex",
+				"submission_client": "plexproxy",
+			},
+		},
+	}
+	if listenType == "single" {
+		listen["listened_at"] = track.StartedAt.Unix()
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"listen_type": listenType,
+		"payload":     []interface{}{listen},
+	})
+	req, err := http.NewRequest(http.MethodPost, mc.listenBrainzUrl+"/1/submit-listens", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(headerContentType, "application/json")
+	req.Header.Set("Authorization", "Token "+token)
+	return mc.do(req)
+}
+
+func (mc *musicClient) callLastfm(method, sessionKey string, track *musicTrack) error {
+	params := url.Values{}
+	params.Set("method", method)
+	params.Set("api_key", mc.lastfmApiKey)
+	params.Set("sk", sessionKey)
+	params.Set("artist", track.Artist)
+	params.Set("track", track.Title)
+	if track.Album != "" {
+		params.Set("album", track.Album)
+	}
+	params.Set("duration", strconv.Itoa(track.Duration/1000))
+	if method == "track.scrobble" {
+		params.Set("timestamp", strconv.FormatInt(track.StartedAt.Unix(), 10))
+	}
+	params.Set("api_sig", signLastfm(params, mc.lastfmApiSecret))
+	params.Set("format", "json")
+
+	req, err := http.NewRequest(http.MethodPost, mc.lastfmUrl, strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(headerContentType, "application/x-www-form-urlencoded")
+	return mc.do(req)
+}
+
+func (mc *musicClient) do(req *http.Request) error {
+	resp, err := mc.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server replied with %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signLastfm concatenates parameters sorted by name and the secret, then hashes them with MD5
+func signLastfm(params url.Values, secret string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		sb.WriteString(k)
+		sb.WriteString(params.Get(k))
+	}
+	sb.WriteString(secret)
+	sum := md5.Sum([]byte(sb.String()))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,349 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/RoyXiang/plexproxy/common"
+	"github.com/bluele/gcache"
+	"github.com/xanderstrike/plexhooks"
+)
+
+const (
+	notifyStyleSlack   = "slack"
+	notifyStyleDiscord = "discord"
+	notifyStyleGotify  = "gotify"
+	notifyStyleCustom  = "custom"
+
+	notifyEventNewDevice = "new_device"
+
+	notifyDefaultRateLimit = time.Minute
+)
+
+var (
+	notifyDefaultTemplates = map[string]string{
+		"play":               `{{.User}} started {{.Title}} on {{.Player}}{{with .Decision}} ({{.}}){{end}}`,
+		"pause":              `{{.User}} paused {{.Title}} on {{.Player}} at {{.Progress}}%`,
+		"resume":             `{{.User}} resumed {{.Title}} on {{.Player}}`,
+		"stop":               `{{.User}} stopped {{.Title}} on {{.Player}} at {{.Progress}}%`,
+		"scrobble":           `{{.User}} finished {{.Title}} on {{.Player}}`,
+		notifyEventNewDevice: `{{.User}} signed in on a new device {{.Player}}{{with .Product}} ({{.}}){{end}} from {{.Ip}}`,
+	}
+
+	notifyFuncs = template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}
+)
+
+type notifyTarget struct {
+	Url       string            `json:"url"`
+	Style     string            `json:"style"`
+	Events    []string          `json:"events"`
+	Users     []string          `json:"users"`
+	Headers   map[string]string `json:"headers"`
+	Title     string            `json:"title"`
+	Templates map[string]string `json:"templates"`
+	Payload   string            `json:"payload"`
+	RateLimit string            `json:"rate_limit"`
+
+	templates map[string]*template.Template
+	payload   *template.Template
+	rateLimit time.Duration
+	sent      gcache.Cache
+}
+
+// notification is the data which message templates are rendered with
+type notification struct {
+	Event     string
+	Time      time.Time
+	User      string
+	UserId    int
+	Type      string
+	Title     string
+	ItemTitle string
+	Show      string
+	Season    int
+	Episode   int
+	Year      int
+	Player    string
+	PlayerId  string
+	Product   string
+	Ip        string
+	Decision  string
+	Progress  int
+
+	// Message is the rendered message, which is only available to payload templates
+	Message string
+}
+
+func (t *notifyTarget) init() error {
+	if t.Url == "" {
+		return fmt.Errorf("url of notification is required")
+	}
+	switch t.Style {
+	case "":
+		t.Style = notifyStyleSlack
+	case notifyStyleSlack, notifyStyleDiscord, notifyStyleGotify:
+	case notifyStyleCustom:
+		if t.Payload == "" {
+			return fmt.Errorf("payload of custom notification is required")
+		}
+		payload, err := template.New("payload").Funcs(notifyFuncs).Parse(t.Payload)
+		if err != nil {
+			return fmt.Errorf("invalid notification payload: %s", err.Error())
+		}
+		t.payload = payload
+	default:
+		return fmt.Errorf("invalid notification style: %q", t.Style)
+	}
+	if t.Title == "" {
+		t.Title = "Plex"
+	}
+	for _, event := range t.Events {
+		if _, ok := notifyDefaultTemplates[event]; !ok {
+			return fmt.Errorf("invalid notification event: %q", event)
+		}
+	}
+
+	for event := range t.Templates {
+		if _, ok := notifyDefaultTemplates[event]; !ok {
+			return fmt.Errorf("invalid notification event: %q", event)
+		}
+	}
+	t.templates = make(map[string]*template.Template, len(notifyDefaultTemplates))
+	for event, text := range notifyDefaultTemplates {
+		if custom, ok := t.Templates[event]; ok {
+			text = custom
+		}
+		tpl, err := template.New(event).Funcs(notifyFuncs).Parse(text)
+		if err != nil {
+			return fmt.Errorf("invalid notification template of %s: %s", event, err.Error())
+		}
+		t.templates[event] = tpl
+	}
+
+	t.rateLimit = notifyDefaultRateLimit
+	if t.RateLimit != "" {
+		rateLimit, err := time.ParseDuration(t.RateLimit)
+		if err != nil || rateLimit < 0 {
+			return fmt.Errorf("invalid notification rate limit: %q", t.RateLimit)
+		}
+		t.rateLimit = rateLimit
+	}
+	t.sent = gcache.New(1000).LRU().Build()
+	return nil
+}
+
+func (t *notifyTarget) match(n *notification) bool {
+	if len(t.Events) > 0 && !containsFold(t.Events, n.Event) {
+		return false
+	}
+	if len(t.Users) > 0 && !matchUser(t.Users, &plexUser{Id: n.UserId, Username: n.User}) {
+		return false
+	}
+	return true
+}
+
+// allow limits notifications of the same event on the same player of a user to one per interval, e.g. seeking
+// triggers pausing and resuming repeatedly
+func (t *notifyTarget) allow(n *notification) bool {
+	if t.rateLimit <= 0 {
+		return true
+	}
+	key := fmt.Sprintf("%d:%s:%s", n.UserId, n.PlayerId, n.Event)
+	if _, err := t.sent.Get(key); err == nil {
+		return false
+	}
+	_ = t.sent.SetWithExpire(key, emptyStruct, t.rateLimit)
+	return true
+}
+
+func (t *notifyTarget) render(n notification) ([]byte, error) {
+	var sb strings.Builder
+	if err := t.templates[n.Event].Execute(&sb, &n); err != nil {
+		return nil, err
+	}
+	n.Message = sb.String()
+
+	switch t.Style {
+	case notifyStyleDiscord:
+		return json.Marshal(map[string]string{"content": n.Message})
+	case notifyStyleGotify:
+		return json.Marshal(map[string]interface{}{"title": t.Title, "message": n.Message, "priority": 5})
+	case notifyStyleCustom:
+		var buf bytes.Buffer
+		if err := t.payload.Execute(&buf, &n); err != nil {
+			return nil, err
+		}
+		if !json.Valid(buf.Bytes()) {
+			return nil, fmt.Errorf("payload is not valid JSON")
+		}
+		return buf.Bytes(), nil
+	default:
+		return json.Marshal(map[string]string{"text": n.Message})
+	}
+}
+
+// notify renders and sends the notification to every matching target
+func (c *PlexClient) notify(n *notification) {
+	for _, target := range c.getRules().Notifications {
+		if !target.match(n) || !target.allow(n) {
+			continue
+		}
+		payload, err := target.render(*n)
+		if err != nil {
+			common.GetLogger().Printf("Failed to render notification of %s: %s", n.Event, err.Error())
+			continue
+		}
+		go func(target *notifyTarget) {
+			if _, err := c.postWebhook(target.Url, target.Headers, payload); err != nil {
+				common.GetLogger().Printf("Failed on sending notification to %s: %s", target.Url, err.Error())
+			}
+		}(target)
+	}
+}
+
+func (c *PlexClient) notifyPlayback(r *http.Request, user *plexUser, session *sessionData, webhook *plexhooks.PlexResponse) {
+	if len(c.getRules().Notifications) == 0 {
+		return
+	}
+	m := session.metadata
+	n := &notification{
+		Event:     strings.TrimPrefix(webhook.Event, "media."),
+		Time:      time.Now(),
+		User:      user.Username,
+		UserId:    user.Id,
+		Type:      webhook.Metadata.Type,
+		Title:     m.Title,
+		ItemTitle: m.Title,
+		Year:      m.Year,
+		Player:    m.Player.Title,
+		PlayerId:  m.Player.MachineIdentifier,
+		Product:   m.Player.Product,
+		Ip:        getClientIP(r),
+		Progress:  session.progress,
+	}
+	if webhook.Metadata.Type == "episode" {
+		n.Show = m.GrandparentTitle
+		n.Season = int(m.ParentIndex)
+		n.Episode = int(m.Index)
+		n.Title = fmt.Sprintf("%s - S%02dE%02d - %s", n.Show, n.Season, n.Episode, n.ItemTitle)
+	} else if n.Year > 0 {
+		n.Title = fmt.Sprintf("%s (%d)", n.ItemTitle, n.Year)
+	}
+	if len(m.Media) > 0 && len(m.Media[0].Part) > 0 {
+		switch m.Media[0].Part[0].Decision {
+		case "directplay":
+			n.Decision = "direct play"
+		case "copy":
+			n.Decision = "direct stream"
+		case "transcode":
+			n.Decision = "transcode"
+		}
+	}
+	c.notify(n)
+}
+
+// deviceRegistry remembers devices which each user has signed in on, and is saved into a file
+type deviceRegistry struct {
+	path string
+
+	mu      sync.Mutex
+	devices map[string]map[string]time.Time
+}
+
+func newDeviceRegistry(path string) (*deviceRegistry, error) {
+	registry := &deviceRegistry{
+		path:    path,
+		devices: make(map[string]map[string]time.Time),
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return registry, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &registry.devices); err != nil {
+		return nil, err
+	}
+	return registry, nil
+}
+
+// Add returns whether the device is new to the user
+func (d *deviceRegistry) Add(userId, device string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	devices, ok := d.devices[userId]
+	if !ok {
+		devices = make(map[string]time.Time)
+		d.devices[userId] = devices
+	} else if _, ok = devices[device]; ok {
+		return false
+	}
+	devices[device] = time.Now()
+	d.save()
+	return true
+}
+
+func (d *deviceRegistry) save() {
+	b, err := json.Marshal(d.devices)
+	if err == nil {
+		tmp := d.path + ".tmp"
+		if err = os.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, d.path)
+		}
+	}
+	if err != nil {
+		common.GetLogger().Printf("Failed to save known devices: %s", err.Error())
+	}
+}
+
+// checkNewDevice notifies once a user signs in on a device for the first time, devices are only remembered if there is
+// a file to keep them and someone to notify
+func (c *PlexClient) checkNewDevice(r *http.Request, user *plexUser) {
+	if c.devices == nil {
+		return
+	}
+	device := r.Header.Get(headerClientIdentity)
+	if device == "" {
+		return
+	}
+	player := r.Header.Get(headerDeviceName)
+	if player == "" {
+		player = device
+	}
+	n := &notification{
+		Event:    notifyEventNewDevice,
+		Time:     time.Now(),
+		User:     user.Username,
+		UserId:   user.Id,
+		Player:   player,
+		PlayerId: device,
+		Product:  r.Header.Get(headerProduct),
+		Ip:       getClientIP(r),
+	}
+	matched := false
+	for _, target := range c.getRules().Notifications {
+		if target.match(n) {
+			matched = true
+			break
+		}
+	}
+	if !matched || !c.devices.Add(strconv.Itoa(user.Id), device) {
+		return
+	}
+	c.notify(n)
+}
@@ -1,17 +1,18 @@
 package handler
 
 import (
-	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/RoyXiang/plexproxy/common"
@@ -21,32 +22,92 @@ import (
 )
 
 type PlexConfig struct {
-	BaseUrl          string
-	Token            string
-	PlaxtUrl         string
-	StaticCacheSize  string
-	StaticCacheTtl   string
-	RedirectWebApp   string
-	DisableTranscode string
-	NoRequestLogs    string
+	BaseUrl           string
+	Token             string
+	PlaxtUrl          string
+	StaticCacheSize   string
+	StaticCacheTtl    string
+	RedirectWebApp    string
+	DisableTranscode  string
+	NoRequestLogs     string
+	BreakerThreshold  string
+	BreakerInterval   string
+	RulesFile         string
+	RulesPollInterval string
+	AuditLog          string
+	AuditLogMaxSize   string
+	AuditLogBackups   string
+	TranscodeQuota    string
+	TraktClientId     string
+	TraktClientSecret string
+	TraktApiUrl       string
+	TraktTokenFile    string
+	ListenBrainzUrl   string
+	LastfmUrl         string
+	LastfmApiKey      string
+	LastfmApiSecret   string
+	WebhookQueueFile  string
+	WebhookSecret     string
+	HistoryFile       string
+	MqttBroker        string
+	MqttClientId      string
+	MqttUsername      string
+	MqttPassword      string
+	MqttTopic         string
+	MqttQos           string
+	MqttRetain        string
+	KnownDevicesFile  string
+	SessionsFile      string
+	TrustedProxies    string
 }
 
 type PlexClient struct {
-	proxy  *httputil.ReverseProxy
-	client *plex.Plex
+	proxy     *httputil.ReverseProxy
+	client    *plex.Plex
+	transport *http.Transport
+
+	breaker *circuitBreaker
 
 	staticCache  gcache.Cache
 	dynamicCache gcache.Cache
+	offlineCache gcache.Cache
 
 	plaxtUrl         string
+	trakt            *traktClient
+	music            *musicClient
+	webhookQueue     *webhookQueue
+	webhookSecret    []byte
+	history          *historyStore
+	mqtt             *mqttPublisher
+	devices          *deviceRegistry
 	redirectWebApp   bool
 	disableTranscode bool
 	NoRequestLogs    bool
+	transcodeQuota   int
+	trustedProxies   []*net.IPNet
+
+	rules     atomic.Pointer[ruleConfig]
+	rulesFile string
+	rulesStop chan struct{}
+	auditLog  io.Writer
+
+	transcodeSessions   []string
+	transcodeSessionsAt time.Time
+	decisions           *decisionHistory
+
+	itemSections gcache.Cache
+	showGuids    gcache.Cache
+	credits      gcache.Cache
+	bans         gcache.Cache
 
 	serverIdentifier *string
 	sections         map[string]*plex.Directory
 	sessions         map[string]*sessionData
-	users            map[string]*plexUser
+	sessionsLive     atomic.Bool
+	sessionsRefresh  chan struct{}
+	sessionsPending  map[string]chan struct{}
+	sessionsFile     string
+	users            map[string]*userEntry
 
 	MulLock common.MultipleLock
 }
@@ -63,8 +124,27 @@ func NewPlexClient(config PlexConfig) *PlexClient {
 	transport := http.DefaultTransport.(*http.Transport).Clone()
 	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 
+	var (
+		breaker          *circuitBreaker
+		breakerThreshold int
+		breakerInterval  time.Duration
+	)
+	if breakerThreshold, err = strconv.Atoi(config.BreakerThreshold); err != nil || breakerThreshold < 0 {
+		breakerThreshold = 5
+	}
+	if breakerInterval, err = time.ParseDuration(config.BreakerInterval); err != nil || breakerInterval <= 0 {
+		breakerInterval = time.Second * 10
+	}
+	if breakerThreshold > 0 {
+		breaker = newCircuitBreaker(transport, strings.TrimSuffix(u.String(), "/"), breakerThreshold, breakerInterval)
+	}
+
 	proxy := httputil.NewSingleHostReverseProxy(u)
-	proxy.Transport = transport
+	if breaker != nil {
+		proxy.Transport = breaker
+	} else {
+		proxy.Transport = transport
+	}
 	proxy.FlushInterval = -1
 	proxy.ErrorLog = common.GetLogger()
 	proxy.ModifyResponse = modifyResponse
@@ -72,11 +152,7 @@ func NewPlexClient(config PlexConfig) *PlexClient {
 
 	client, _ := plex.New(config.BaseUrl, config.Token)
 
-	var plaxtUrl string
-	u, err = url.Parse(config.PlaxtUrl)
-	if err == nil && strings.HasSuffix(u.Path, "/api") && u.Query().Get("id") != "" {
-		plaxtUrl = u.String()
-	}
+	plaxtUrl := parsePlaxtUrl(config.PlaxtUrl)
 
 	var (
 		staticCacheSize int
@@ -90,6 +166,7 @@ func NewPlexClient(config PlexConfig) *PlexClient {
 	}
 	staticCache := gcache.New(staticCacheSize).LFU().Expiration(staticCacheTtl).Build()
 	dynamicCache := gcache.New(100).LRU().Expiration(time.Second).Build()
+	offlineCache := gcache.New(offlineCacheSize).LRU().Expiration(offlineCacheTtl).Build()
 
 	var redirectWebApp, disableTranscode, noRequestLogs bool
 	if b, err := strconv.ParseBool(config.RedirectWebApp); err == nil {
@@ -108,20 +185,148 @@ func NewPlexClient(config PlexConfig) *PlexClient {
 		noRequestLogs = false
 	}
 
-	return &PlexClient{
+	rules, err := loadRuleConfig(config.RulesFile)
+	if err != nil {
+		common.GetLogger().Fatalf("Failed to load rules from %s: %s", config.RulesFile, err.Error())
+	}
+
+	var trakt *traktClient
+	if config.TraktClientId != "" && config.TraktClientSecret != "" {
+		traktApiUrl := config.TraktApiUrl
+		if traktApiUrl == "" {
+			traktApiUrl = "https://api.trakt.tv"
+		}
+		traktTokenFile := config.TraktTokenFile
+		if traktTokenFile == "" {
+			traktTokenFile = "trakt.json"
+		}
+		if trakt, err = newTraktClient(traktApiUrl, config.TraktClientId, config.TraktClientSecret, traktTokenFile); err != nil {
+			common.GetLogger().Fatalf("Failed to load Trakt tokens from %s: %s", traktTokenFile, err.Error())
+		}
+	}
+
+	var transcodeQuota int
+	if transcodeQuota, err = strconv.Atoi(config.TranscodeQuota); err != nil || transcodeQuota < 0 {
+		transcodeQuota = 0
+	}
+
+	var auditLog io.Writer
+	if config.AuditLog != "" {
+		var auditLogMaxSize, auditLogBackups int
+		if auditLogMaxSize, err = strconv.Atoi(config.AuditLogMaxSize); err != nil || auditLogMaxSize <= 0 {
+			auditLogMaxSize = 100
+		}
+		if auditLogBackups, err = strconv.Atoi(config.AuditLogBackups); err != nil || auditLogBackups < 0 {
+			auditLogBackups = 5
+		}
+		auditLog, err = common.NewRotatingFile(config.AuditLog, int64(auditLogMaxSize)<<20, auditLogBackups)
+		if err != nil {
+			common.GetLogger().Fatalf("Failed to open audit log %s: %s", config.AuditLog, err.Error())
+		}
+	}
+
+	var history *historyStore
+	if config.HistoryFile != "" {
+		if history, err = newHistoryStore(config.HistoryFile); err != nil {
+			common.GetLogger().Fatalf("Failed to open history database %s: %s", config.HistoryFile, err.Error())
+		}
+	}
+
+	var mqttPublisher *mqttPublisher
+	if config.MqttBroker != "" {
+		mqttPublisher, err = newMqttPublisher(config.MqttBroker, config.MqttClientId, config.MqttUsername, config.MqttPassword, config.MqttTopic, config.MqttQos, config.MqttRetain)
+		if err != nil {
+			common.GetLogger().Fatalf("Failed to set up MQTT publisher: %s", err.Error())
+		}
+	}
+
+	if config.TrustedProxies == "" {
+		config.TrustedProxies = defaultTrustedProxies
+	}
+	trustedProxies, err := parseNetworks(config.TrustedProxies)
+	if err != nil {
+		common.GetLogger().Fatalf("Failed to parse trusted proxies: %s", err.Error())
+	}
+
+	var devices *deviceRegistry
+	if config.KnownDevicesFile != "" {
+		if devices, err = newDeviceRegistry(config.KnownDevicesFile); err != nil {
+			common.GetLogger().Fatalf("Failed to load known devices from %s: %s", config.KnownDevicesFile, err.Error())
+		}
+	}
+
+	c := &PlexClient{
 		proxy:            proxy,
 		client:           client,
+		transport:        transport,
+		breaker:          breaker,
 		plaxtUrl:         plaxtUrl,
+		trakt:            trakt,
+		webhookSecret:    []byte(config.WebhookSecret),
+		history:          history,
+		mqtt:             mqttPublisher,
+		devices:          devices,
+		music:            newMusicClient(config.ListenBrainzUrl, config.LastfmUrl, config.LastfmApiKey, config.LastfmApiSecret),
 		staticCache:      staticCache,
 		dynamicCache:     dynamicCache,
+		offlineCache:     offlineCache,
 		redirectWebApp:   redirectWebApp,
 		disableTranscode: disableTranscode,
 		NoRequestLogs:    noRequestLogs,
+		transcodeQuota:   transcodeQuota,
+		trustedProxies:   trustedProxies,
+		decisions:        newDecisionHistory(decisionHistorySize),
+		rulesFile:        config.RulesFile,
+		auditLog:         auditLog,
+		itemSections:     gcache.New(1000).LRU().Expiration(time.Hour).Build(),
+		showGuids:        gcache.New(100).LRU().Expiration(time.Hour * 24).Build(),
+		credits:          gcache.New(100).LRU().Expiration(time.Hour).Build(),
+		bans:             gcache.New(1000).LRU().Build(),
 		sections:         make(map[string]*plex.Directory, 0),
 		sessions:         make(map[string]*sessionData),
-		users:            make(map[string]*plexUser),
+		sessionsRefresh:  make(chan struct{}, 1),
+		sessionsPending:  make(map[string]chan struct{}),
+		sessionsFile:     config.SessionsFile,
+		users:            make(map[string]*userEntry),
 		MulLock:          common.NewMultipleLock(),
 	}
+	c.rules.Store(rules)
+	if config.WebhookQueueFile != "" {
+		if c.webhookQueue, err = newWebhookQueue(config.WebhookQueueFile, c.postWebhook); err != nil {
+			common.GetLogger().Fatalf("Failed to load webhook queue from %s: %s", config.WebhookQueueFile, err.Error())
+		}
+		go c.webhookQueue.Run()
+	}
+	if config.RulesFile != "" {
+		var rulesPollInterval time.Duration
+		if rulesPollInterval, err = time.ParseDuration(config.RulesPollInterval); err != nil || rulesPollInterval < 0 {
+			rulesPollInterval = time.Second * 30
+		}
+		if rulesPollInterval > 0 {
+			c.rulesStop = make(chan struct{})
+			go c.watchRules(config.RulesFile, rulesPollInterval, c.rulesStop)
+		}
+	}
+	if config.SessionsFile != "" {
+		if err = c.loadSessions(); err != nil {
+			common.GetLogger().Fatalf("Failed to load sessions from %s: %s", config.SessionsFile, err.Error())
+		}
+		c.refreshSessions()
+		go c.persistSessions()
+	}
+	if config.Token != "" {
+		go c.watchSessions()
+		go c.refreshUsers()
+	}
+	return c
+}
+
+func parsePlaxtUrl(value string) string {
+	u, err := url.Parse(value)
+	if err == nil && strings.HasSuffix(u.Path, "/api") && u.Query().Get("id") != "" {
+		return u.String()
+	}
+	return ""
 }
 
 func (u *plexUser) MarshalBinary() ([]byte, error) {
@@ -151,19 +356,43 @@ func (c *PlexClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// If it is an authorized request
 	if user := r.Context().Value(userCtxKey); user != nil {
-		switch path {
-		case "/:/timeline":
+		c.checkNewDevice(r, user.(*plexUser))
+		if c.IsSectionHidden(r, user.(*plexUser)) {
+			writePlexError(w, http.StatusForbidden)
+			return
+		} else if isSectionFilteredPath(path) && len(c.getHiddenSections(user.(*plexUser))) > 0 {
+			// responses would be rewritten, so they should not be compressed
+			r.Header.Del(headerAcceptEncoding)
+		}
+		switch {
+		case path == "/:/timeline":
 			go c.syncTimelineWithPlaxt(r, user.(*plexUser))
-		case "/video/:/transcode/universal/decision":
-			if c.disableTranscode {
-				r = c.disableTranscoding(r)
-			}
+		case path == "/video/:/transcode/universal/decision":
+			// profiles are augmented at first, so that their params could not override transcode policies or caps
+			r = c.augmentClientProfile(r)
+			r = c.applyTranscodePolicy(r, user.(*plexUser))
+			r = c.enforceTranscodeCaps(r, user.(*plexUser))
+			// responses would be inspected, so they should not be compressed
+			r.Header.Del(headerAcceptEncoding)
+		case strings.HasPrefix(path, "/video/:/transcode/universal/start"):
+			r = c.augmentClientProfile(r)
+			r = c.enforceTranscodeCaps(r, user.(*plexUser))
 		}
 	}
 
 	c.proxy.ServeHTTP(w, r)
 }
 
+func (c *PlexClient) WriteAuditRecord(record *auditRecord) {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	if _, err = c.auditLog.Write(append(b, '\n')); err != nil {
+		common.GetLogger().Printf("Failed to write audit log: %s", err.Error())
+	}
+}
+
 func (c *PlexClient) IsTokenSet() bool {
 	c.MulLock.RLock(lockKeyToken)
 	defer c.MulLock.RUnlock(lockKeyToken)
@@ -172,45 +401,97 @@ func (c *PlexClient) IsTokenSet() bool {
 }
 
 func (c *PlexClient) GetUser(token string) *plexUser {
-	if user := c.searchUser(token); user != nil {
+	if user, ok := c.searchUser(token); ok {
 		return user
 	}
 	c.fetchUsers(token)
-	return c.searchUser(token)
+	user, _ := c.searchUser(token)
+	return user
 }
 
-func (c *PlexClient) searchUser(token string) *plexUser {
+// searchUser returns the user of the token, and whether the token is cached, a cached token could be invalid
+func (c *PlexClient) searchUser(token string) (*plexUser, bool) {
 	c.MulLock.RLock(lockKeyUsers)
 	defer c.MulLock.RUnlock(lockKeyUsers)
 
-	if user, ok := c.users[token]; ok {
-		return user
+	if entry, ok := c.users[token]; ok && time.Now().Before(entry.expiresAt) {
+		return entry.user, true
 	}
-	return nil
+	return nil, false
 }
 
 func (c *PlexClient) fetchUsers(token string) {
 	c.MulLock.Lock(lockKeyUsers)
 	defer c.MulLock.Unlock(lockKeyUsers)
 
-	userInfo := c.GetAccountInfo(token)
-	if userInfo.ID > 0 {
-		user := plexUser{
-			Id:       userInfo.ID,
-			Username: userInfo.Username,
+	// it might have been fetched while waiting for the lock
+	if entry, ok := c.users[token]; ok && time.Now().Before(entry.expiresAt) {
+		return
+	}
+
+	userInfo, err := c.GetAccountInfo(token)
+	if err == nil && userInfo.ID > 0 {
+		c.users[token] = &userEntry{
+			user: &plexUser{
+				Id:       userInfo.ID,
+				Username: userInfo.Username,
+			},
+			expiresAt: time.Now().Add(userCacheTtl),
 		}
-		c.users[token] = &user
 		return
 	}
 
-	response := c.GetSharedServers()
-	if response != nil {
-		for _, friend := range response.Friends {
-			user := plexUser{
+	// the token is only known to be invalid if plex.tv rejected it, otherwise it would be checked again next time
+	rejected := err == nil || isInvalidTokenError(err)
+	if !rejected {
+		common.GetLogger().Printf("Failed to get account info: %s", err.Error())
+	}
+
+	// tokens of friends are looked up in the friend list, a rejected token is cached as invalid even without the list
+	if response := c.GetSharedServers(); response != nil {
+		c.updateSharedUsers(response)
+	}
+	if _, ok := c.users[token]; !ok && rejected {
+		c.users[token] = &userEntry{
+			expiresAt: time.Now().Add(userInvalidTtl),
+		}
+	}
+}
+
+// refreshUsers fetches the shared server list periodically, so that tokens of friends are kept up to date
+func (c *PlexClient) refreshUsers() {
+	for range time.Tick(usersRefreshInterval) {
+		response := c.GetSharedServers()
+		if response == nil {
+			continue
+		}
+		c.MulLock.Lock(lockKeyUsers)
+		c.updateSharedUsers(response)
+		c.MulLock.Unlock(lockKeyUsers)
+	}
+}
+
+// updateSharedUsers caches tokens of friends, removes tokens which have been revoked, and purges expired ones
+func (c *PlexClient) updateSharedUsers(response *plex.SharedServersResponse) {
+	now := time.Now()
+	tokens := make(map[string]struct{}, len(response.Friends))
+	for _, friend := range response.Friends {
+		tokens[friend.AccessToken] = emptyStruct
+		c.users[friend.AccessToken] = &userEntry{
+			user: &plexUser{
 				Id:       friend.UserId,
 				Username: friend.Username,
-			}
-			c.users[friend.AccessToken] = &user
+			},
+			shared:    true,
+			expiresAt: now.Add(userCacheTtl),
+		}
+	}
+	for token, entry := range c.users {
+		if _, ok := tokens[token]; entry.shared && !ok {
+			common.GetLogger().Printf("Access of user %s has been revoked", entry.user.Username)
+			delete(c.users, token)
+		} else if !now.Before(entry.expiresAt) {
+			delete(c.users, token)
 		}
 	}
 }
@@ -235,7 +516,7 @@ func (c *PlexClient) GetSharedServers() *plex.SharedServersResponse {
 	return &response
 }
 
-func (c *PlexClient) GetAccountInfo(token string) (user plex.UserPlexTV) {
+func (c *PlexClient) GetAccountInfo(token string) (user plex.UserPlexTV, err error) {
 	c.MulLock.Lock(lockKeyToken)
 	originalToken := c.client.Token
 	defer func() {
@@ -244,12 +525,17 @@ func (c *PlexClient) GetAccountInfo(token string) (user plex.UserPlexTV) {
 	}()
 
 	c.client.Token = token
-	user, _ = c.client.MyAccount()
+	user, err = c.client.MyAccount()
 	return
 }
 
+// isInvalidTokenError reports whether plex.tv has rejected the token, rather than failed to answer
+func isInvalidTokenError(err error) bool {
+	return err.Error() == plex.ErrorInvalidToken || strings.HasPrefix(err.Error(), strconv.Itoa(http.StatusUnauthorized)+" ")
+}
+
 func (c *PlexClient) syncTimelineWithPlaxt(r *http.Request, user *plexUser) {
-	if c.plaxtUrl == "" || !c.IsTokenSet() {
+	if !c.isScrobblingEnabled() || !c.IsTokenSet() {
 		return
 	}
 
@@ -275,8 +561,29 @@ func (c *PlexClient) syncTimelineWithPlaxt(r *http.Request, user *plexUser) {
 	viewOffset, err := strconv.Atoi(playbackTime)
 	if err != nil {
 		return
+	}
+	var metadata *plex.MediaMetadata
+	if session.partial {
+		// live sessions carry decisions of their media, and details of their players and users
+		if live := c.getLiveSession(sessionKey, ratingKey); live != nil {
+			c.fillSession(session, *live, r, user)
+		} else if metadata = c.getMetadata(ratingKey); metadata == nil || len(metadata.MediaContainer.Metadata) == 0 {
+			return
+		} else {
+			c.fillSession(session, metadata.MediaContainer.Metadata[0], r, user)
+		}
+	}
+	sectionId := session.metadata.LibrarySectionID.String()
+	section := c.getLibrarySection(sectionId)
+	if section == nil {
+		return
+	} else if section.Type == "artist" {
+		c.scrobbleTrack(user, session, state, viewOffset)
+		return
+	} else if section.Type != "show" && section.Type != "movie" {
+		return
 	} else if viewOffset == 0 {
-		if session.progress >= watchedThreshold {
+		if session.watched {
 			// time would become 0 once a playback session was finished
 			viewOffset = session.metadata.Duration
 		} else if session.status != sessionUnplayed {
@@ -286,44 +593,46 @@ func (c *PlexClient) syncTimelineWithPlaxt(r *http.Request, user *plexUser) {
 	originalSession := *session
 	progress := int(math.Round(float64(viewOffset) / float64(session.metadata.Duration) * 100.0))
 
-	externalGuids := make([]plexhooks.ExternalGuid, 0)
+	var externalGuids []plexhooks.ExternalGuid
 	if session.guids == nil {
-		metadata := c.getMetadata(ratingKey)
 		if metadata == nil {
+			metadata = c.getMetadata(ratingKey)
+		}
+		if metadata == nil || len(metadata.MediaContainer.Metadata) == 0 {
 			return
 		} else if metadata.MediaContainer.Metadata[0].OriginalTitle != "" {
 			session.metadata.Title = metadata.MediaContainer.Metadata[0].OriginalTitle
 		}
-		for _, guid := range metadata.MediaContainer.Metadata[0].AltGUIDs {
-			externalGuids = append(externalGuids, plexhooks.ExternalGuid{
-				Id: guid.ID,
-			})
-		}
+		externalGuids = toExternalGuids(metadata.MediaContainer.Metadata[0].AltGUIDs)
 		session.guids = externalGuids
 	} else {
 		externalGuids = session.guids
 	}
+	var (
+		showGuid  string
+		showGuids []plexhooks.ExternalGuid
+	)
+	if section.Type == "show" {
+		showGuid, showGuids = c.getShowGuids(session.metadata.GrandparentRatingKey)
+	}
 
+	watched := c.isWatched(section.Type, ratingKey, viewOffset, session.metadata.Duration)
 	var event string
-	var threshold int
 	switch state {
 	case "playing":
-		threshold = 100
 		if session.status == sessionUnplayed || session.status == sessionStopped {
 			event = webhookEventPlay
 		} else {
 			event = webhookEventResume
 		}
 	case "paused":
-		threshold = watchedThreshold
 		event = webhookEventPause
 	case "stopped":
-		threshold = watchedThreshold
 		event = webhookEventStop
 	}
 	if event == "" {
 		return
-	} else if progress >= threshold {
+	} else if progress >= 100 || (state != "playing" && watched) {
 		event = webhookEventScrobble
 	}
 	switch event {
@@ -336,7 +645,15 @@ func (c *PlexClient) syncTimelineWithPlaxt(r *http.Request, user *plexUser) {
 	}
 	session.lastEvent = event
 	session.progress = progress
+	session.watched = watched
 	shouldScrobble := session.Check(originalSession)
+	if c.history != nil {
+		if shouldScrobble {
+			c.recordHistory(r, user, session, originalSession.status, section.Type, event, viewOffset)
+		} else if session.status == sessionPlaying && time.Since(session.historyAt) >= historyProgressInterval {
+			c.recordHistory(r, user, session, originalSession.status, section.Type, historyEventProgress, viewOffset)
+		}
+	}
 	if !shouldScrobble {
 		return
 	}
@@ -345,11 +662,6 @@ func (c *PlexClient) syncTimelineWithPlaxt(r *http.Request, user *plexUser) {
 	if serverIdentifier == "" {
 		return
 	}
-	sectionId := session.metadata.LibrarySectionID.String()
-	section := c.getLibrarySection(sectionId)
-	if section == nil || (section.Type != "show" && section.Type != "movie") {
-		return
-	}
 
 	webhook := plexhooks.PlexResponse{
 		Event: event,
@@ -364,7 +676,9 @@ func (c *PlexClient) syncTimelineWithPlaxt(r *http.Request, user *plexUser) {
 			Uuid: serverIdentifier,
 		},
 		Player: plexhooks.Player{
-			Uuid: session.metadata.Player.MachineIdentifier,
+			Local: session.metadata.Player.Local,
+			Title: session.metadata.Player.Title,
+			Uuid:  session.metadata.Player.MachineIdentifier,
 		},
 		Metadata: plexhooks.Metadata{
 			LibrarySectionType: section.Type,
@@ -377,20 +691,59 @@ func (c *PlexClient) syncTimelineWithPlaxt(r *http.Request, user *plexUser) {
 			ViewOffset:         viewOffset,
 		},
 	}
-	b, _ := json.Marshal(webhook)
-	resp, err := c.client.HTTPClient.Post(c.plaxtUrl, "application/json", bytes.NewBuffer(b))
-	if err != nil {
-		common.GetLogger().Printf("Failed on sending webhook to Plaxt: %s", err.Error())
-		return
+	if section.Type == "show" {
+		webhook.Metadata.Type = "episode"
+		webhook.Metadata.GrandparentRatingKey = session.metadata.GrandparentRatingKey
+		webhook.Metadata.GrandparentKey = session.metadata.GrandparentKey
+		webhook.Metadata.GrandparentTitle = session.metadata.GrandparentTitle
+		webhook.Metadata.ParentRatingKey = session.metadata.ParentRatingKey
+		webhook.Metadata.ParentKey = session.metadata.ParentKey
+		webhook.Metadata.ParentTitle = session.metadata.ParentTitle
+		webhook.Metadata.ParentIndex = int(session.metadata.ParentIndex)
+		webhook.Metadata.Index = int(session.metadata.Index)
+	} else {
+		webhook.Metadata.Type = "movie"
+	}
+	c.fanOutWebhook(user, &webhook, showGuid, showGuids)
+	if c.mqtt != nil {
+		c.publishMqtt(user, &webhook, showGuids)
+	}
+	c.notifyPlayback(r, user, session, &webhook)
+	// a queued scrobble would be delivered eventually, scrobbling the session again would make it a duplicate
+	accepted := false
+	if plaxtUrl := c.getPlaxtUrl(user); plaxtUrl != "" && c.sendToPlaxt(plaxtUrl, &webhook, showGuid, showGuids) != webhookFailed {
+		accepted = true
+	}
+	if c.trakt != nil && c.trakt.Scrobble(strconv.Itoa(user.Id), &webhook, showGuids) {
+		accepted = true
 	}
-	defer func(Body io.ReadCloser) {
-		_ = Body.Close()
-	}(resp.Body)
-	if event == webhookEventScrobble && resp.StatusCode == http.StatusOK {
+	if event == webhookEventScrobble && accepted {
 		session.status = sessionWatched
 	}
 }
 
+// getPlaxtUrl returns the Plaxt URL of the user if there is a mapping, otherwise PLAXT_URL
+func (c *PlexClient) getPlaxtUrl(user *plexUser) string {
+	mapping := c.getRules().Plaxt
+	if len(mapping) == 0 {
+		return c.plaxtUrl
+	}
+	if plaxtUrl, ok := mapping[strconv.Itoa(user.Id)]; ok {
+		return plaxtUrl
+	}
+	for name, plaxtUrl := range mapping {
+		if strings.EqualFold(name, user.Username) {
+			return plaxtUrl
+		}
+	}
+	return ""
+}
+
+func (c *PlexClient) sendToPlaxt(plaxtUrl string, webhook *plexhooks.PlexResponse, showGuid string, showGuids []plexhooks.ExternalGuid) webhookDeliveryState {
+	b, _ := json.Marshal(newPlexWebhook(webhook, showGuid, showGuids))
+	return c.deliverWebhook(plaxtUrl, nil, b, webhook.Event)
+}
+
 func (c *PlexClient) getServerIdentifier() string {
 	if c.serverIdentifier == nil {
 		identity, err := c.client.GetServerIdentity()
@@ -446,6 +799,12 @@ func (c *PlexClient) getPlayerSession(playerIdentifier, ratingKey string) (strin
 	if key, session := c.searchPlayerSession(playerIdentifier, ratingKey); session != nil {
 		return key, session
 	}
+	// sessions are tracked by notifications, it falls back to fetching all sessions if the notification never comes
+	if c.sessionsLive.Load() {
+		if key, session := c.waitPlayerSession(playerIdentifier, ratingKey); session != nil {
+			return key, session
+		}
+	}
 	c.fetchPlayerSessions()
 	return c.searchPlayerSession(playerIdentifier, ratingKey)
 }
@@ -454,6 +813,11 @@ func (c *PlexClient) searchPlayerSession(playerIdentifier, ratingKey string) (st
 	c.MulLock.RLock(lockKeySessions)
 	defer c.MulLock.RUnlock(lockKeySessions)
 
+	return c.findPlayerSession(playerIdentifier, ratingKey)
+}
+
+// findPlayerSession searches the session of the player and the item, the lock of all sessions must be held
+func (c *PlexClient) findPlayerSession(playerIdentifier, ratingKey string) (string, *sessionData) {
 	for key, session := range c.sessions {
 		if session.metadata.Player.MachineIdentifier == playerIdentifier && session.metadata.RatingKey == ratingKey {
 			return key, session
@@ -476,25 +840,53 @@ func (c *PlexClient) fetchPlayerSessions() {
 		return
 	}
 
+	now := time.Now()
 	keys := make(map[string]struct{}, len(sessions.MediaContainer.Metadata))
 	for _, session := range sessions.MediaContainer.Metadata {
 		keys[session.SessionKey] = emptyStruct
-		if _, ok := c.sessions[session.SessionKey]; !ok {
-			c.sessions[session.SessionKey] = &sessionData{
-				metadata: session,
-				guids:    nil,
-				status:   sessionUnplayed,
+		if data, ok := c.sessions[session.SessionKey]; ok && data.metadata.RatingKey == session.RatingKey {
+			if data.user == nil {
+				data.user = getSessionUser(&session)
 			}
+			data.state = session.Player.State
+			data.updatedAt = now
+			continue
 		}
-	}
-	for key := range c.sessions {
-		if _, ok := keys[key]; !ok {
+		c.addSession(session.SessionKey, &sessionData{
+			metadata:  session,
+			guids:     nil,
+			status:    sessionUnplayed,
+			user:      getSessionUser(&session),
+			state:     session.Player.State,
+			createdAt: now,
+			updatedAt: now,
+		})
+	}
+	// ended sessions are kept for a while, so that their last timelines could still be handled
+	for key, session := range c.sessions {
+		if _, ok := keys[key]; ok {
+			continue
+		}
+		session.state = sessionStateStopped
+		if now.Sub(session.updatedAt) > sessionExpiry {
 			c.sessions[key] = nil
 			delete(c.sessions, key)
 		}
 	}
 }
 
+// getSessionUser returns the user of a session on Plex, whose ID might be a local one, e.g. 1 for the owner
+func getSessionUser(session *plex.Metadata) *plexUser {
+	if session.User.Title == "" {
+		return nil
+	}
+	id, _ := strconv.Atoi(session.User.ID)
+	return &plexUser{
+		Id:       id,
+		Username: session.User.Title,
+	}
+}
+
 func (c *PlexClient) getMetadata(ratingKey string) *plex.MediaMetadata {
 	c.MulLock.RLock(lockKeyToken)
 	defer c.MulLock.RUnlock(lockKeyToken)
@@ -507,6 +899,36 @@ func (c *PlexClient) getMetadata(ratingKey string) *plex.MediaMetadata {
 	return &metadata
 }
 
+// getShowGuids returns the GUID and external GUIDs of the show, which are cached since they rarely change
+func (c *PlexClient) getShowGuids(ratingKey string) (string, []plexhooks.ExternalGuid) {
+	if ratingKey == "" {
+		return "", nil
+	}
+	if show, err := c.showGuids.Get(ratingKey); err == nil {
+		return show.(*showGuids).guid, show.(*showGuids).guids
+	}
+	metadata := c.getMetadata(ratingKey)
+	if metadata == nil || len(metadata.MediaContainer.Metadata) == 0 {
+		return "", nil
+	}
+	show := &showGuids{
+		guid:  metadata.MediaContainer.Metadata[0].GUID,
+		guids: toExternalGuids(metadata.MediaContainer.Metadata[0].AltGUIDs),
+	}
+	_ = c.showGuids.Set(ratingKey, show)
+	return show.guid, show.guids
+}
+
+func toExternalGuids(guids []plex.AltGUID) []plexhooks.ExternalGuid {
+	externalGuids := make([]plexhooks.ExternalGuid, 0, len(guids))
+	for _, guid := range guids {
+		externalGuids = append(externalGuids, plexhooks.ExternalGuid{
+			Id: guid.ID,
+		})
+	}
+	return externalGuids
+}
+
 func (c *PlexClient) disableTranscoding(r *http.Request) *http.Request {
 	query := r.URL.Query()
 	query.Del("maxVideoBitrate")
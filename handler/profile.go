@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"net/http"
+	"strings"
+)
+
+type profileRule struct {
+	Products  []string          `json:"products"`
+	Platforms []string          `json:"platforms"`
+	Models    []string          `json:"models"`
+	Remove    []string          `json:"remove"`
+	Add       []string          `json:"add"`
+	Params    map[string]string `json:"params"`
+}
+
+func (rule *profileRule) match(r *http.Request) bool {
+	if len(rule.Products) > 0 && !containsFold(rule.Products, r.Header.Get(headerProduct)) {
+		return false
+	}
+	if len(rule.Platforms) > 0 && !containsFold(rule.Platforms, r.Header.Get(headerPlatform)) {
+		return false
+	}
+	if len(rule.Models) > 0 && !containsFold(rule.Models, r.Header.Get(headerDevice)) && !containsFold(rule.Models, r.Header.Get(headerModel)) {
+		return false
+	}
+	return true
+}
+
+// augmentClientProfile applies all matching profile rules to the extra profile and the query of a playback request
+func (c *PlexClient) augmentClientProfile(r *http.Request) *http.Request {
+	matched := false
+	query := r.URL.Query()
+	headers := r.Header
+	for _, rule := range c.getRules().Profiles {
+		if !rule.match(r) {
+			continue
+		}
+		matched = true
+
+		var params []string
+		if extraProfile := headers.Get(headerExtraProfile); extraProfile != "" {
+			params = strings.Split(extraProfile, "+")
+		}
+		i := 0
+		for _, value := range params {
+			removed := false
+			for _, prefix := range rule.Remove {
+				if strings.HasPrefix(value, prefix) {
+					removed = true
+					break
+				}
+			}
+			if !removed {
+				params[i] = value
+				i++
+			}
+		}
+		params = append(params[:i], rule.Add...)
+		if len(params) > 0 {
+			headers.Set(headerExtraProfile, strings.Join(params, "+"))
+		} else {
+			headers.Del(headerExtraProfile)
+		}
+
+		for k, v := range rule.Params {
+			if v == "" {
+				query.Del(k)
+			} else {
+				query.Set(k, v)
+			}
+		}
+	}
+	if !matched {
+		return r
+	}
+	return cloneRequest(r, headers, query)
+}
@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/RoyXiang/plexproxy/common"
+	"github.com/gorilla/mux"
+)
+
+const (
+	queueInterval    = time.Second * 10
+	queueMinBackoff  = time.Second * 30
+	queueMaxBackoff  = time.Hour * 6
+	queueStaleEvents = time.Hour
+)
+
+type webhookDeliveryState int
+
+const (
+	webhookFailed webhookDeliveryState = iota
+	webhookQueued
+	webhookDelivered
+)
+
+type webhookDelivery struct {
+	Id            string            `json:"id"`
+	Url           string            `json:"url"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Payload       json.RawMessage   `json:"payload"`
+	Event         string            `json:"event"`
+	CreatedAt     time.Time         `json:"created_at"`
+	Attempts      int               `json:"attempts"`
+	NextAttemptAt time.Time         `json:"next_attempt_at"`
+	LastError     string            `json:"last_error"`
+}
+
+type webhookQueue struct {
+	path string
+	post func(url string, headers map[string]string, payload []byte) (int, error)
+
+	mu    sync.Mutex
+	items []*webhookDelivery
+}
+
+func newWebhookQueue(path string, post func(string, map[string]string, []byte) (int, error)) (*webhookQueue, error) {
+	q := &webhookQueue{
+		path:  path,
+		post:  post,
+		items: make([]*webhookDelivery, 0),
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return q, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &q.items); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *webhookQueue) Push(url string, headers map[string]string, payload []byte, event string, err error) {
+	now := time.Now()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.items = append(q.items, &webhookDelivery{
+		Id:            strconv.FormatInt(now.UnixNano(), 36),
+		Url:           url,
+		Headers:       headers,
+		Payload:       payload,
+		Event:         event,
+		CreatedAt:     now,
+		Attempts:      1,
+		NextAttemptAt: now.Add(queueMinBackoff),
+		LastError:     err.Error(),
+	})
+	q.save()
+}
+
+func (q *webhookQueue) List() []*webhookDelivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	items := make([]*webhookDelivery, len(q.items))
+	copy(items, q.items)
+	return items
+}
+
+func (q *webhookQueue) Remove(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, item := range q.items {
+		if item.Id == id {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			q.save()
+			return true
+		}
+	}
+	return false
+}
+
+func (q *webhookQueue) Run() {
+	for range time.Tick(queueInterval) {
+		q.process()
+	}
+}
+
+// process retries deliveries which are due, drops those rejected permanently, and drops stale events except stops and
+// scrobbles
+func (q *webhookQueue) process() {
+	now := time.Now()
+	q.mu.Lock()
+	due := make([]*webhookDelivery, 0)
+	kept := q.items[:0]
+	changed := false
+	for _, item := range q.items {
+		if isStaleWebhook(item, now) {
+			common.GetLogger().Printf("Dropped stale webhook %s (%s) to %s", item.Id, item.Event, item.Url)
+			changed = true
+			continue
+		}
+		kept = append(kept, item)
+		if !now.Before(item.NextAttemptAt) {
+			due = append(due, item)
+		}
+	}
+	q.items = kept
+	if changed {
+		q.save()
+	}
+	q.mu.Unlock()
+
+	if len(due) == 0 {
+		return
+	}
+	removed := make(map[string]bool, len(due))
+	for _, item := range due {
+		if status, err := q.post(item.Url, item.Headers, item.Payload); err != nil {
+			if isPermanentFailure(status) {
+				common.GetLogger().Printf("Dropped rejected webhook %s (%s) to %s: %s", item.Id, item.Event, item.Url, err.Error())
+				removed[item.Id] = true
+				continue
+			}
+			q.mu.Lock()
+			item.Attempts++
+			item.LastError = err.Error()
+			backoff := queueMinBackoff << (item.Attempts - 1)
+			if backoff <= 0 || backoff > queueMaxBackoff {
+				backoff = queueMaxBackoff
+			}
+			item.NextAttemptAt = time.Now().Add(backoff)
+			q.mu.Unlock()
+			continue
+		}
+		common.GetLogger().Printf("Delivered queued webhook %s (%s) to %s", item.Id, item.Event, item.Url)
+		removed[item.Id] = true
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	kept = q.items[:0]
+	for _, item := range q.items {
+		if !removed[item.Id] {
+			kept = append(kept, item)
+		}
+	}
+	q.items = kept
+	q.save()
+}
+
+// isStaleWebhook reports whether the event has been outdated, only events of ongoing playbacks would expire
+func isStaleWebhook(item *webhookDelivery, now time.Time) bool {
+	switch item.Event {
+	case webhookEventStop, webhookEventScrobble:
+		return false
+	}
+	return now.Sub(item.CreatedAt) > queueStaleEvents
+}
+
+// isPermanentFailure reports whether the receiver rejected the webhook in a way that retrying would not help
+func isPermanentFailure(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return status >= http.StatusBadRequest && status < http.StatusInternalServerError
+}
+
+// save writes the queue into a temporary file at first, then replaces the original one
+func (q *webhookQueue) save() {
+	b, err := json.Marshal(q.items)
+	if err == nil {
+		tmp := q.path + ".tmp"
+		if err = os.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, q.path)
+		}
+	}
+	if err != nil {
+		common.GetLogger().Printf("Failed to save webhook queue: %s", err.Error())
+	}
+}
+
+// deliverWebhook posts the payload, and queues it for retrying on failure unless it is rejected permanently
+func (c *PlexClient) deliverWebhook(url string, headers map[string]string, payload []byte, event string) webhookDeliveryState {
+	status, err := c.postWebhook(url, headers, payload)
+	if err == nil {
+		return webhookDelivered
+	}
+	common.GetLogger().Printf("Failed on sending webhook to %s: %s", url, err.Error())
+	if c.webhookQueue == nil || isPermanentFailure(status) {
+		return webhookFailed
+	}
+	c.webhookQueue.Push(url, headers, payload, event, err)
+	return webhookQueued
+}
+
+func (c *PlexClient) ListWebhookQueue(w http.ResponseWriter, _ *http.Request) {
+	writeJson(w, c.webhookQueue.List())
+}
+
+func (c *PlexClient) RemoveFromWebhookQueue(w http.ResponseWriter, r *http.Request) {
+	if !c.webhookQueue.Remove(mux.Vars(r)["id"]) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,137 @@
+package handler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+type accessSchedule struct {
+	Users       []string `json:"users"`
+	Timezone    string   `json:"timezone"`
+	Days        []string `json:"days"`
+	Start       string   `json:"start"`
+	End         string   `json:"end"`
+	GracePeriod string   `json:"grace_period"`
+
+	location *time.Location
+	days     map[time.Weekday]bool
+	start    int
+	end      int
+	grace    time.Duration
+}
+
+func (s *accessSchedule) init() (err error) {
+	if s.location, err = time.LoadLocation(s.Timezone); err != nil {
+		return
+	}
+	s.days = make(map[time.Weekday]bool, len(weekdays))
+	if len(s.Days) == 0 {
+		for _, day := range weekdays {
+			s.days[day] = true
+		}
+	}
+	for _, name := range s.Days {
+		day, ok := weekdays[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("invalid weekday: %q", name)
+		}
+		s.days[day] = true
+	}
+	if s.start, err = parseClock(s.Start); err != nil {
+		return
+	}
+	if s.end, err = parseClock(s.End); err != nil {
+		return
+	}
+	if s.GracePeriod != "" {
+		if s.grace, err = time.ParseDuration(s.GracePeriod); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// contains reports whether t falls into the schedule, a window ending before it starts spans midnight, and a window
+// ending when it starts covers the whole day
+func (s *accessSchedule) contains(t time.Time) bool {
+	lt := t.In(s.location)
+	minutes := lt.Hour()*60 + lt.Minute()
+	weekday := lt.Weekday()
+	switch {
+	case s.start == s.end:
+		return s.days[weekday]
+	case s.start < s.end:
+		return s.days[weekday] && minutes >= s.start && minutes < s.end
+	case minutes >= s.start:
+		return s.days[weekday]
+	case minutes < s.end:
+		return s.days[(weekday+6)%7]
+	}
+	return false
+}
+
+func (s *accessSchedule) containsWithGrace(t time.Time) bool {
+	return s.grace > 0 && s.contains(t.Add(-s.grace))
+}
+
+// CheckSchedule returns whether the user is inside one of their schedules, or within the grace period of one while
+// the device is still playing a stream which started inside it
+func (c *PlexClient) CheckSchedule(user *plexUser, device string, t time.Time) bool {
+	restricted := false
+	graces := make([]*accessSchedule, 0)
+	for _, s := range c.getRules().Schedules {
+		if !matchUser(s.Users, user) {
+			continue
+		}
+		restricted = true
+		if s.contains(t) {
+			return true
+		} else if s.containsWithGrace(t) {
+			graces = append(graces, s)
+		}
+	}
+	return !restricted || (len(graces) > 0 && c.hasActiveSession(user, device, graces))
+}
+
+// hasActiveSession searches tracked sessions for a live one of the user on the device, which started inside any of
+// the schedules
+func (c *PlexClient) hasActiveSession(user *plexUser, playerIdentifier string, schedules []*accessSchedule) bool {
+	if playerIdentifier == "" {
+		return false
+	}
+	c.MulLock.RLock(lockKeySessions)
+	defer c.MulLock.RUnlock(lockKeySessions)
+
+	for _, session := range c.sessions {
+		if session.metadata.Player.MachineIdentifier != playerIdentifier || session.state == sessionStateStopped {
+			continue
+		} else if session.user == nil || (session.user.Id != user.Id && !strings.EqualFold(session.user.Username, user.Username)) {
+			continue
+		}
+		for _, s := range schedules {
+			if s.contains(session.createdAt) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
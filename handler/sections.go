@@ -0,0 +1,259 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type sectionFilter struct {
+	Users    []string `json:"users"`
+	Sections []string `json:"sections"`
+}
+
+type xmlNode struct {
+	XMLName xml.Name
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Nodes   []*xmlNode `xml:",any"`
+}
+
+func (n *xmlNode) attr(name string) string {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+func (n *xmlNode) setAttr(name, value string) {
+	for i, a := range n.Attrs {
+		if a.Name.Local == name {
+			n.Attrs[i].Value = value
+			return
+		}
+	}
+}
+
+func (c *PlexClient) getHiddenSections(user *plexUser) map[string]bool {
+	hidden := make(map[string]bool)
+	for _, filter := range c.getRules().HiddenSections {
+		if matchUser(filter.Users, user) {
+			for _, section := range filter.Sections {
+				hidden[section] = true
+			}
+		}
+	}
+	return hidden
+}
+
+// getHiddenSectionsKey returns a key of sections hidden from user, so that cached responses are not shared with users
+// who could not see them
+func (c *PlexClient) getHiddenSectionsKey(user *plexUser) string {
+	hidden := c.getHiddenSections(user)
+	sections := make([]string, 0, len(hidden))
+	for section := range hidden {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+	return strings.Join(sections, ",")
+}
+
+// IsSectionHidden reports whether the request refers directly to a section, or an item of a section, hidden from user,
+// images transcoded from an item are checked by their source
+func (c *PlexClient) IsSectionHidden(r *http.Request, user *plexUser) bool {
+	hidden := c.getHiddenSections(user)
+	if len(hidden) == 0 {
+		return false
+	}
+	path := r.URL.EscapedPath()
+	if path == "/photo/:/transcode" {
+		u, err := url.Parse(r.URL.Query().Get("url"))
+		if err != nil || (u.Host != "" && u.Hostname() != "127.0.0.1") {
+			return false
+		}
+		path = u.EscapedPath()
+	}
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 3 {
+		return false
+	}
+	switch parts[0] + "/" + parts[1] {
+	case "library/sections", "hubs/sections":
+		return hidden[parts[2]]
+	case "library/metadata":
+		return hidden[c.getItemSection(parts[2])]
+	}
+	return false
+}
+
+func (c *PlexClient) getItemSection(ratingKey string) string {
+	if sectionId, err := c.itemSections.Get(ratingKey); err == nil {
+		return sectionId.(string)
+	}
+	metadata := c.getMetadata(ratingKey)
+	if metadata == nil || len(metadata.MediaContainer.Metadata) == 0 {
+		return ""
+	}
+	sectionId := metadata.MediaContainer.Metadata[0].LibrarySectionID.String()
+	_ = c.itemSections.Set(ratingKey, sectionId)
+	return sectionId
+}
+
+func isSectionFilteredPath(path string) bool {
+	switch path {
+	case "/library/sections", "/hubs", "/search", "/library/search":
+		return true
+	}
+	return strings.HasPrefix(path, "/hubs/")
+}
+
+func filterSections(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	path := resp.Request.URL.EscapedPath()
+	if !isSectionFilteredPath(path) {
+		return nil
+	}
+	user, ok := resp.Request.Context().Value(userCtxKey).(*plexUser)
+	if !ok {
+		return nil
+	}
+	hidden := plexClient.getHiddenSections(user)
+	if len(hidden) == 0 {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get(headerContentType))
+	isJson := strings.HasSuffix(mediaType, "json")
+	if !isJson && !strings.HasSuffix(mediaType, "xml") {
+		return nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	sectionList := path == "/library/sections"
+	if isJson {
+		var root map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err = decoder.Decode(&root); err == nil {
+			filterJsonNode(root, hidden, sectionList)
+			body, err = json.Marshal(root)
+		}
+	} else {
+		root := &xmlNode{}
+		if err = xml.Unmarshal(body, root); err == nil {
+			filterXmlNode(root, hidden, sectionList)
+			if body, err = xml.Marshal(root); err == nil {
+				body = append([]byte(xml.Header), body...)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+func isHiddenElement(attr func(string) string, hidden map[string]bool, sectionList bool) bool {
+	if sectionId := attr("librarySectionID"); sectionId != "" {
+		return hidden[sectionId]
+	}
+	return sectionList && hidden[attr("key")]
+}
+
+// filterJsonNode removes hidden elements beneath node, and reports whether node has been emptied by doing so
+func filterJsonNode(node map[string]interface{}, hidden map[string]bool, sectionList bool) bool {
+	emptied, changed := false, false
+	remaining, removed := 0, 0
+	for key, value := range node {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if filterJsonNode(v, hidden, sectionList) {
+				emptied = true
+			}
+		case []interface{}:
+			kept := v[:0]
+			for _, item := range v {
+				if child, ok := item.(map[string]interface{}); ok {
+					attr := func(name string) string {
+						if value, ok := child[name]; ok && value != nil {
+							return fmt.Sprint(value)
+						}
+						return ""
+					}
+					if isHiddenElement(attr, hidden, sectionList) || filterJsonNode(child, hidden, sectionList) {
+						continue
+					}
+				}
+				kept = append(kept, item)
+			}
+			if len(kept) < len(v) {
+				changed = true
+				emptied = emptied || len(kept) == 0
+				removed += len(v) - len(kept)
+			}
+			node[key] = kept
+			remaining += len(kept)
+		}
+	}
+	if changed {
+		if _, ok := node["size"]; ok {
+			node["size"] = remaining
+		}
+		if value, ok := node["totalSize"]; ok {
+			if totalSize, err := strconv.Atoi(fmt.Sprint(value)); err == nil {
+				node["totalSize"] = adjustTotalSize(totalSize, removed, remaining)
+			}
+		}
+	}
+	return emptied && remaining == 0
+}
+
+// filterXmlNode removes hidden elements beneath node, and reports whether node has been emptied by doing so
+func filterXmlNode(node *xmlNode, hidden map[string]bool, sectionList bool) bool {
+	if len(node.Nodes) == 0 {
+		return false
+	}
+	kept := node.Nodes[:0]
+	for _, child := range node.Nodes {
+		if isHiddenElement(child.attr, hidden, sectionList) || filterXmlNode(child, hidden, sectionList) {
+			continue
+		}
+		kept = append(kept, child)
+	}
+	if len(kept) == len(node.Nodes) {
+		return false
+	}
+	removed := len(node.Nodes) - len(kept)
+	node.Nodes = kept
+	node.setAttr("size", strconv.Itoa(len(kept)))
+	if totalSize, err := strconv.Atoi(node.attr("totalSize")); err == nil {
+		node.setAttr("totalSize", strconv.Itoa(adjustTotalSize(totalSize, removed, len(kept))))
+	}
+	return len(kept) == 0
+}
+
+// adjustTotalSize excludes removed elements from the total size of all pages, which could not be less than the size of
+// the current page
+func adjustTotalSize(totalSize, removed, size int) int {
+	if totalSize -= removed; totalSize < size {
+		totalSize = size
+	}
+	return totalSize
+}
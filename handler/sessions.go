@@ -0,0 +1,370 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RoyXiang/plexproxy/common"
+	"github.com/gorilla/websocket"
+	"github.com/jrudio/go-plex-client"
+	"github.com/xanderstrike/plexhooks"
+)
+
+const (
+	sessionStateStopped = "stopped"
+
+	sessionReconcileInterval = time.Minute
+	sessionExpiry            = time.Minute
+	sessionPendingTimeout    = time.Second * 5
+	sessionPersistInterval   = time.Second * 30
+	notificationRetryDelay   = time.Second * 10
+	notificationPingInterval = time.Second * 30
+	notificationTimeout      = time.Second * 10
+)
+
+// watchSessions keeps sessions up to date with notifications from Plex, and reconciles them with all sessions on
+// Plex periodically or once connected
+func (c *PlexClient) watchSessions() {
+	go c.subscribeNotifications()
+
+	ticker := time.NewTicker(sessionReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.sessionsRefresh:
+		}
+		c.fetchPlayerSessions()
+	}
+}
+
+// refreshSessions requests a reconciliation without waiting for it, requests are merged if one is pending
+func (c *PlexClient) refreshSessions() {
+	select {
+	case c.sessionsRefresh <- emptyStruct:
+	default:
+	}
+}
+
+// subscribeNotifications connects to the websocket of Plex, and reconnects once it is disconnected
+func (c *PlexClient) subscribeNotifications() {
+	for {
+		conn, err := c.dialNotifications()
+		if err != nil {
+			common.GetLogger().Printf("Failed to subscribe to notifications of Plex: %s", err.Error())
+		} else {
+			c.sessionsLive.Store(true)
+			c.refreshSessions()
+			err = c.readNotifications(conn)
+			c.sessionsLive.Store(false)
+			common.GetLogger().Printf("Disconnected from notifications of Plex: %s", err.Error())
+		}
+		time.Sleep(notificationRetryDelay)
+	}
+}
+
+// dialNotifications connects through the same transport as proxied requests, so that their TLS settings apply
+func (c *PlexClient) dialNotifications() (*websocket.Conn, error) {
+	c.MulLock.RLock(lockKeyToken)
+	baseUrl, token := c.client.URL, c.client.Token
+	c.MulLock.RUnlock(lockKeyToken)
+
+	u, err := url.Parse(baseUrl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		u.Scheme = "wss"
+	} else {
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/:/websockets/notifications"
+
+	dialer := &websocket.Dialer{
+		Proxy:            c.transport.Proxy,
+		NetDialContext:   c.transport.DialContext,
+		TLSClientConfig:  c.transport.TLSClientConfig,
+		HandshakeTimeout: notificationTimeout,
+	}
+	conn, resp, err := dialer.Dial(u.String(), http.Header{headerToken: []string{token}})
+	if resp != nil && resp.Body != nil {
+		_ = resp.Body.Close()
+	}
+	return conn, err
+}
+
+// readNotifications handles notifications until the connection is broken, which is kept alive by pings
+func (c *PlexClient) readNotifications(conn *websocket.Conn) error {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(notificationPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(notificationTimeout)) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	extendDeadline := func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(notificationPingInterval + notificationTimeout))
+	}
+	conn.SetPongHandler(extendDeadline)
+	for {
+		_ = extendDeadline("")
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		var n notificationMessage
+		if err = json.Unmarshal(message, &n); err != nil {
+			continue
+		}
+		if n.NotificationContainer.Type == "playing" {
+			c.onPlaying(n.NotificationContainer.PlaySessionStateNotification)
+		}
+	}
+}
+
+// onPlaying keeps sessions up to date with notifications, and builds unknown ones from them, details of which would
+// be filled on their first timelines
+func (c *PlexClient) onPlaying(notifications []playSessionNotification) {
+	c.MulLock.Lock(lockKeySessions)
+	defer c.MulLock.Unlock(lockKeySessions)
+
+	now := time.Now()
+	for _, n := range notifications {
+		session, ok := c.sessions[n.SessionKey]
+		if !ok || session.metadata.RatingKey != n.RatingKey {
+			if n.State == sessionStateStopped || n.ClientIdentifier == "" || n.RatingKey == "" {
+				continue
+			}
+			session = &sessionData{
+				metadata: plex.Metadata{
+					Key:        n.Key,
+					RatingKey:  n.RatingKey,
+					SessionKey: n.SessionKey,
+					Player: plex.Player{
+						MachineIdentifier: n.ClientIdentifier,
+					},
+				},
+				status:    sessionUnplayed,
+				partial:   true,
+				createdAt: now,
+			}
+			c.addSession(n.SessionKey, session)
+		}
+		session.state = n.State
+		session.updatedAt = now
+	}
+}
+
+// addSession stores the session, and wakes up timelines waiting for it, the lock of all sessions must be held
+func (c *PlexClient) addSession(key string, session *sessionData) {
+	c.sessions[key] = session
+	pendingKey := session.metadata.Player.MachineIdentifier + ":" + session.metadata.RatingKey
+	if ch, ok := c.sessionsPending[pendingKey]; ok {
+		close(ch)
+		delete(c.sessionsPending, pendingKey)
+	}
+}
+
+// waitPlayerSession waits for the notification of a session, since a timeline could arrive before it
+func (c *PlexClient) waitPlayerSession(playerIdentifier, ratingKey string) (string, *sessionData) {
+	pendingKey := playerIdentifier + ":" + ratingKey
+	c.MulLock.Lock(lockKeySessions)
+	if key, session := c.findPlayerSession(playerIdentifier, ratingKey); session != nil {
+		c.MulLock.Unlock(lockKeySessions)
+		return key, session
+	}
+	ch, ok := c.sessionsPending[pendingKey]
+	if !ok {
+		ch = make(chan struct{})
+		c.sessionsPending[pendingKey] = ch
+	}
+	c.MulLock.Unlock(lockKeySessions)
+
+	timer := time.NewTimer(sessionPendingTimeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+	case <-timer.C:
+		c.MulLock.Lock(lockKeySessions)
+		if c.sessionsPending[pendingKey] == ch {
+			delete(c.sessionsPending, pendingKey)
+		}
+		c.MulLock.Unlock(lockKeySessions)
+	}
+	return c.searchPlayerSession(playerIdentifier, ratingKey)
+}
+
+// fillSession fills details of a session built from a notification with its metadata and the timeline request
+// getLiveSession returns the session playing the item on Plex
+func (c *PlexClient) getLiveSession(sessionKey, ratingKey string) *plex.Metadata {
+	sessions, err := c.getLiveSessions()
+	if err != nil {
+		common.GetLogger().Printf("Failed to fetch playback sessions: %s", err.Error())
+		return nil
+	}
+	for _, session := range sessions.MediaContainer.Metadata {
+		if session.SessionKey == sessionKey && session.RatingKey == ratingKey {
+			return &session
+		}
+	}
+	return nil
+}
+
+// fillSession completes a session built from a notification with metadata of a live session or the item, details of
+// the player and the user are taken from the request if the metadata lacks them
+func (c *PlexClient) fillSession(session *sessionData, metadata plex.Metadata, r *http.Request, user *plexUser) {
+	metadata.Key = session.metadata.Key
+	metadata.RatingKey = session.metadata.RatingKey
+	metadata.SessionKey = session.metadata.SessionKey
+	if metadata.Player.MachineIdentifier == "" {
+		metadata.Player = plex.Player{
+			Address:           getClientIP(r),
+			Device:            r.Header.Get(headerDevice),
+			Local:             getNetworkClass(r) == networkLan,
+			MachineIdentifier: session.metadata.Player.MachineIdentifier,
+			Platform:          r.Header.Get(headerPlatform),
+			Product:           r.Header.Get(headerProduct),
+			Title:             r.Header.Get(headerDeviceName),
+		}
+	}
+	if metadata.User.Title == "" {
+		metadata.User = plex.User{
+			ID:    strconv.Itoa(user.Id),
+			Title: user.Username,
+		}
+	}
+
+	c.MulLock.Lock(lockKeySessions)
+	session.metadata = metadata
+	session.user = user
+	c.MulLock.Unlock(lockKeySessions)
+	session.partial = false
+}
+
+type sessionSnapshot struct {
+	Key       string                   `json:"key"`
+	Metadata  plex.Metadata            `json:"metadata"`
+	Guids     []plexhooks.ExternalGuid `json:"guids"`
+	LastEvent string                   `json:"last_event"`
+	Status    sessionStatus            `json:"status"`
+	Progress  int                      `json:"progress"`
+	Watched   bool                     `json:"watched"`
+	HistoryAt time.Time                `json:"history_at"`
+	Partial   bool                     `json:"partial,omitempty"`
+	User      *plexUser                `json:"user,omitempty"`
+	State     string                   `json:"state"`
+	CreatedAt time.Time                `json:"created_at"`
+	UpdatedAt time.Time                `json:"updated_at"`
+}
+
+// persistSessions saves sessions into the file periodically
+func (c *PlexClient) persistSessions() {
+	for range time.Tick(sessionPersistInterval) {
+		c.saveSessions()
+	}
+}
+
+// saveSessions writes sessions into a temporary file at first, then replaces the original one
+func (c *PlexClient) saveSessions() {
+	if c.sessionsFile == "" {
+		return
+	}
+	// the lock of all sessions is released before taking the lock of each one, otherwise a slow scrobble would block
+	// every lookup of sessions
+	c.MulLock.RLock(lockKeySessions)
+	snapshots := make([]*sessionSnapshot, 0, len(c.sessions))
+	sessions := make([]*sessionData, 0, len(c.sessions))
+	for key, session := range c.sessions {
+		snapshots = append(snapshots, &sessionSnapshot{
+			Key:       key,
+			User:      session.user,
+			State:     session.state,
+			CreatedAt: session.createdAt,
+			UpdatedAt: session.updatedAt,
+		})
+		sessions = append(sessions, session)
+	}
+	c.MulLock.RUnlock(lockKeySessions)
+
+	for i, snapshot := range snapshots {
+		session := sessions[i]
+		lockKey := fmt.Sprintf("plex:session:%s", snapshot.Key)
+		c.MulLock.Lock(lockKey)
+		snapshot.Metadata = session.metadata
+		snapshot.Guids = session.guids
+		snapshot.LastEvent = session.lastEvent
+		snapshot.Status = session.status
+		snapshot.Progress = session.progress
+		snapshot.Watched = session.watched
+		snapshot.HistoryAt = session.historyAt
+		snapshot.Partial = session.partial
+		c.MulLock.Unlock(lockKey)
+	}
+
+	b, err := json.Marshal(snapshots)
+	if err == nil {
+		tmp := c.sessionsFile + ".tmp"
+		if err = os.WriteFile(tmp, b, 0600); err == nil {
+			err = os.Rename(tmp, c.sessionsFile)
+		}
+	}
+	if err != nil {
+		common.GetLogger().Printf("Failed to save sessions: %s", err.Error())
+	}
+}
+
+// loadSessions restores sessions from the file, they would be reconciled with live sessions on Plex later
+func (c *PlexClient) loadSessions() error {
+	b, err := os.ReadFile(c.sessionsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var snapshots []*sessionSnapshot
+	if err = json.Unmarshal(b, &snapshots); err != nil {
+		return err
+	}
+
+	c.MulLock.Lock(lockKeySessions)
+	defer c.MulLock.Unlock(lockKeySessions)
+
+	for _, snapshot := range snapshots {
+		c.sessions[snapshot.Key] = &sessionData{
+			metadata:  snapshot.Metadata,
+			guids:     snapshot.Guids,
+			lastEvent: snapshot.LastEvent,
+			status:    snapshot.Status,
+			progress:  snapshot.Progress,
+			watched:   snapshot.Watched,
+			historyAt: snapshot.HistoryAt,
+			partial:   snapshot.Partial,
+			user:      snapshot.User,
+			state:     snapshot.State,
+			createdAt: snapshot.CreatedAt,
+			updatedAt: snapshot.UpdatedAt,
+		}
+	}
+	return nil
+}
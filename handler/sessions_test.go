@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/RoyXiang/plexproxy/common"
+	"github.com/jrudio/go-plex-client"
+)
+
+func TestFillSessionFromLiveSession(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/status/sessions" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set(headerContentType, "application/json")
+		_, _ = w.Write([]byte(`{"MediaContainer": {"size": 1, "Metadata": [{
+			"sessionKey": "7", "ratingKey": "10", "key": "/library/metadata/10", "title": "Movie",
+			"Media": [{"Part": [{"decision": "directplay"}]}],
+			"Player": {"machineIdentifier": "player", "title": "Living Room", "product": "Plex Web", "local": true},
+			"User": {"id": "1", "title": "alice", "thumb": "https://plex.tv/users/1/avatar"}
+		}]}}`))
+	}))
+	defer server.Close()
+
+	client, err := plex.New(server.URL, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &PlexClient{client: client, MulLock: common.NewMultipleLock()}
+	session := &sessionData{
+		metadata: plex.Metadata{
+			Key:        "/library/metadata/10",
+			RatingKey:  "10",
+			SessionKey: "7",
+			Player:     plex.Player{MachineIdentifier: "player"},
+		},
+		partial: true,
+	}
+
+	live := c.getLiveSession("7", "10")
+	if live == nil {
+		t.Fatal("live session is not found")
+	}
+	if c.getLiveSession("7", "11") != nil {
+		t.Error("unexpected live session of another item")
+	}
+	user := &plexUser{Id: 123, Username: "alice"}
+	c.fillSession(session, *live, httptest.NewRequest(http.MethodGet, "/:/timeline", nil), user)
+
+	m := session.metadata
+	if session.partial || session.user != user || m.Title != "Movie" {
+		t.Errorf("session is not filled: %+v", session)
+	}
+	if len(m.Media) == 0 || len(m.Media[0].Part) == 0 || m.Media[0].Part[0].Decision != "directplay" {
+		t.Errorf("decision is missing: %+v", m.Media)
+	}
+	if m.Player.Title != "Living Room" || !m.Player.Local || m.User.Thumb == "" {
+		t.Errorf("player or user is missing: %+v, %+v", m.Player, m.User)
+	}
+}
@@ -18,15 +18,90 @@ type cacheInfo struct {
 
 type sessionStatus int64
 
+// sessionData is guarded by the lock of the session, while user, state and timestamps are guarded by the lock of all
+// sessions, metadata is only replaced while holding both since sessions are searched by its player and item
 type sessionData struct {
 	metadata  plex.Metadata
 	guids     []plexhooks.ExternalGuid
 	lastEvent string
 	status    sessionStatus
 	progress  int
+	historyAt time.Time
+	watched   bool
+	// partial is true if the session was built from a notification, and it has not been filled yet
+	partial bool
+
+	user      *plexUser
+	state     string
+	createdAt time.Time
+	updatedAt time.Time
 }
 
 type plexUser struct {
 	Id       int    `json:"id"`
 	Username string `json:"username"`
 }
+
+type userEntry struct {
+	// user is nil if the token is invalid
+	user      *plexUser
+	shared    bool
+	expiresAt time.Time
+}
+
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	Username    string    `json:"username,omitempty"`
+	UserId      int       `json:"user_id,omitempty"`
+	Device      string    `json:"device,omitempty"`
+	Product     string    `json:"product,omitempty"`
+	IP          string    `json:"ip"`
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	RatingKey   string    `json:"rating_key,omitempty"`
+	Status      int       `json:"status"`
+	Bytes       int       `json:"bytes"`
+	CacheStatus string    `json:"cache_status,omitempty"`
+}
+
+type transcodeSessionsResponse struct {
+	MediaContainer struct {
+		TranscodeSession []struct {
+			Key           string `json:"key"`
+			VideoDecision string `json:"videoDecision"`
+		} `json:"TranscodeSession"`
+	} `json:"MediaContainer"`
+}
+
+type markersResponse struct {
+	MediaContainer struct {
+		Metadata []struct {
+			Marker []struct {
+				Type            string `json:"type"`
+				StartTimeOffset int    `json:"startTimeOffset"`
+				Final           bool   `json:"final"`
+			} `json:"Marker"`
+		} `json:"Metadata"`
+	} `json:"MediaContainer"`
+}
+
+type playSessionNotification struct {
+	SessionKey       string `json:"sessionKey"`
+	ClientIdentifier string `json:"clientIdentifier"`
+	Key              string `json:"key"`
+	RatingKey        string `json:"ratingKey"`
+	State            string `json:"state"`
+	ViewOffset       int    `json:"viewOffset"`
+}
+
+type notificationMessage struct {
+	NotificationContainer struct {
+		Type                         string                    `json:"type"`
+		PlaySessionStateNotification []playSessionNotification `json:"PlaySessionStateNotification"`
+	} `json:"NotificationContainer"`
+}
+
+type showGuids struct {
+	guid  string
+	guids []plexhooks.ExternalGuid
+}
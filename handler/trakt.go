@@ -0,0 +1,414 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RoyXiang/plexproxy/common"
+	"github.com/xanderstrike/plexhooks"
+)
+
+const (
+	traktActionStart = "start"
+	traktActionPause = "pause"
+	traktActionStop  = "stop"
+)
+
+type traktToken struct {
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+}
+
+type traktTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+type traktDeviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationUrl string `json:"verification_url"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval"`
+}
+
+type traktItem struct {
+	Title  string                 `json:"title,omitempty"`
+	Year   int                    `json:"year,omitempty"`
+	Season int                    `json:"season,omitempty"`
+	Number int                    `json:"number,omitempty"`
+	Ids    map[string]interface{} `json:"ids,omitempty"`
+}
+
+type traktScrobble struct {
+	Movie    *traktItem `json:"movie,omitempty"`
+	Show     *traktItem `json:"show,omitempty"`
+	Episode  *traktItem `json:"episode,omitempty"`
+	Progress float64    `json:"progress"`
+}
+
+type traktClient struct {
+	apiUrl       string
+	clientId     string
+	clientSecret string
+	tokenFile    string
+	httpClient   *http.Client
+	locks        common.MultipleLock
+
+	mu      sync.RWMutex
+	tokens  map[string]*traktToken
+	pending map[string]*traktDeviceCode
+}
+
+func newTraktClient(apiUrl, clientId, clientSecret, tokenFile string) (*traktClient, error) {
+	c := &traktClient{
+		apiUrl:       strings.TrimSuffix(apiUrl, "/"),
+		clientId:     clientId,
+		clientSecret: clientSecret,
+		tokenFile:    tokenFile,
+		httpClient:   &http.Client{Timeout: time.Second * 30},
+		locks:        common.NewMultipleLock(),
+		tokens:       make(map[string]*traktToken),
+		pending:      make(map[string]*traktDeviceCode),
+	}
+	b, err := os.ReadFile(tokenFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, err
+	}
+	if err = json.Unmarshal(b, &c.tokens); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (t *traktClient) IsLinked(userId string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	_, ok := t.tokens[userId]
+	return ok
+}
+
+// Authorize starts a device authorization for the user, and polls for the token in background, concurrent requests of
+// the same user share one authorization
+func (t *traktClient) Authorize(userId string) (*traktDeviceCode, error) {
+	lockKey := "trakt:authorize:" + userId
+	t.locks.Lock(lockKey)
+	defer t.locks.Unlock(lockKey)
+
+	t.mu.RLock()
+	code, ok := t.pending[userId]
+	t.mu.RUnlock()
+	if ok {
+		return code, nil
+	}
+
+	code = &traktDeviceCode{}
+	if err := t.post("/oauth/device/code", "", map[string]string{"client_id": t.clientId}, code); err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.pending[userId] = code
+	t.mu.Unlock()
+	go t.pollToken(userId, code)
+	return code, nil
+}
+
+func (t *traktClient) Unlink(userId string) error {
+	// a refresh in progress would store the token again
+	lockKey := "trakt:refresh:" + userId
+	t.locks.Lock(lockKey)
+	defer t.locks.Unlock(lockKey)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.tokens, userId)
+	return t.saveTokens()
+}
+
+func (t *traktClient) pollToken(userId string, code *traktDeviceCode) {
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, userId)
+		t.mu.Unlock()
+	}()
+
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = time.Second * 5
+	}
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		var token traktTokenResponse
+		err := t.post("/oauth/device/token", "", map[string]string{
+			"code":          code.DeviceCode,
+			"client_id":     t.clientId,
+			"client_secret": t.clientSecret,
+		}, &token)
+		var statusErr *traktStatusError
+		switch {
+		case err == nil:
+			t.storeToken(userId, &token)
+			common.GetLogger().Printf("Trakt account linked for user %s", userId)
+			return
+		case errors.As(err, &statusErr) && statusErr.code == http.StatusBadRequest:
+			// pending
+		case errors.As(err, &statusErr) && statusErr.code == http.StatusTooManyRequests:
+			interval += time.Second
+		default:
+			common.GetLogger().Printf("Failed to link Trakt account for user %s: %s", userId, err.Error())
+			return
+		}
+	}
+}
+
+func (t *traktClient) storeToken(userId string, resp *traktTokenResponse) {
+	createdAt := time.Now()
+	if resp.CreatedAt > 0 {
+		createdAt = time.Unix(resp.CreatedAt, 0)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.tokens[userId] = &traktToken{
+		AccessToken:  resp.AccessToken,
+		RefreshToken: resp.RefreshToken,
+		ExpiresAt:    createdAt.Add(time.Duration(resp.ExpiresIn) * time.Second),
+	}
+	if err := t.saveTokens(); err != nil {
+		common.GetLogger().Printf("Failed to save Trakt tokens: %s", err.Error())
+	}
+}
+
+func (t *traktClient) saveTokens() error {
+	b, err := json.Marshal(t.tokens)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(t.tokenFile, b, 0600)
+}
+
+func (t *traktClient) getToken(userId string) *traktToken {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.tokens[userId]
+}
+
+// getAccessToken returns the access token of the user, which would be refreshed if it expires within a day. Refreshes
+// of the same user are serialized, since every refresh rotates the refresh token
+func (t *traktClient) getAccessToken(userId string) string {
+	token := t.getToken(userId)
+	if token == nil {
+		return ""
+	} else if time.Until(token.ExpiresAt) > time.Hour*24 {
+		return token.AccessToken
+	}
+
+	lockKey := "trakt:refresh:" + userId
+	t.locks.Lock(lockKey)
+	defer t.locks.Unlock(lockKey)
+
+	// it might have been refreshed while waiting for the lock
+	if token = t.getToken(userId); token == nil {
+		return ""
+	} else if time.Until(token.ExpiresAt) > time.Hour*24 {
+		return token.AccessToken
+	}
+
+	var resp traktTokenResponse
+	err := t.post("/oauth/token", "", map[string]string{
+		"refresh_token": token.RefreshToken,
+		"client_id":     t.clientId,
+		"client_secret": t.clientSecret,
+		"redirect_uri":  "urn:ietf:wg:oauth:2.0:oob",
+		"grant_type":    "refresh_token",
+	}, &resp)
+	if err != nil {
+		common.GetLogger().Printf("Failed to refresh Trakt token for user %s: %s", userId, err.Error())
+		if time.Now().Before(token.ExpiresAt) {
+			return token.AccessToken
+		}
+		return ""
+	}
+	t.storeToken(userId, &resp)
+	return resp.AccessToken
+}
+
+// Scrobble sends the playback event to Trakt on behalf of the user, returns whether it has been accepted. Episodes are
+// identified by the show and their season and episode numbers if IDs of the show are known
+func (t *traktClient) Scrobble(userId string, webhook *plexhooks.PlexResponse, showGuids []plexhooks.ExternalGuid) bool {
+	var action string
+	switch webhook.Event {
+	case webhookEventPlay, webhookEventResume:
+		action = traktActionStart
+	case webhookEventPause:
+		action = traktActionPause
+	case webhookEventStop, webhookEventScrobble:
+		action = traktActionStop
+	default:
+		return false
+	}
+	if webhook.Metadata.Duration <= 0 {
+		return false
+	}
+	accessToken := t.getAccessToken(userId)
+	if accessToken == "" {
+		return false
+	}
+
+	metadata := webhook.Metadata
+	body := traktScrobble{
+		Progress: float64(metadata.ViewOffset) / float64(metadata.Duration) * 100.0,
+	}
+	ids := getTraktIds(metadata.ExternalGuid)
+	switch metadata.LibrarySectionType {
+	case "movie":
+		if len(ids) == 0 {
+			return false
+		}
+		body.Movie = &traktItem{
+			Title: metadata.Title,
+			Year:  metadata.Year,
+			Ids:   ids,
+		}
+	case "show":
+		if showIds := getTraktIds(showGuids); len(showIds) > 0 && metadata.Index > 0 {
+			body.Show = &traktItem{
+				Title: metadata.GrandparentTitle,
+				Ids:   showIds,
+			}
+			body.Episode = &traktItem{
+				Season: metadata.ParentIndex,
+				Number: metadata.Index,
+			}
+		} else if len(ids) > 0 {
+			body.Episode = &traktItem{
+				Ids: ids,
+			}
+		} else {
+			return false
+		}
+	default:
+		return false
+	}
+
+	err := t.post("/scrobble/"+action, accessToken, body, nil)
+	var statusErr *traktStatusError
+	if err != nil && !(errors.As(err, &statusErr) && statusErr.code == http.StatusConflict) {
+		common.GetLogger().Printf("Failed on scrobbling to Trakt: %s", err.Error())
+		return false
+	}
+	return true
+}
+
+type traktStatusError struct {
+	code int
+}
+
+func (e *traktStatusError) Error() string {
+	return fmt.Sprintf("Trakt replied with %d", e.code)
+}
+
+func (t *traktClient) post(path, accessToken string, body, result interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.apiUrl+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(headerContentType, "application/json")
+	req.Header.Set("trakt-api-version", "2")
+	req.Header.Set("trakt-api-key", t.clientId)
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return &traktStatusError{code: resp.StatusCode}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// getTraktIds converts GUIDs like imdb://tt0133093 or tmdb://603 to Trakt IDs
+func getTraktIds(guids []plexhooks.ExternalGuid) map[string]interface{} {
+	ids := make(map[string]interface{}, len(guids))
+	for _, guid := range guids {
+		parts := strings.SplitN(guid.Id, "://", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "imdb":
+			ids[parts[0]] = parts[1]
+		case "tmdb", "tvdb":
+			if id, err := strconv.Atoi(parts[1]); err == nil {
+				ids[parts[0]] = id
+			}
+		}
+	}
+	return ids
+}
+
+func (c *PlexClient) AuthorizeTrakt(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userCtxKey).(*plexUser)
+	code, err := c.trakt.Authorize(strconv.Itoa(user.Id))
+	if err != nil {
+		common.GetLogger().Printf("Failed to request a Trakt device code: %s", err.Error())
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	writeJson(w, map[string]interface{}{
+		"user_code":        code.UserCode,
+		"verification_url": code.VerificationUrl,
+		"expires_in":       code.ExpiresIn,
+	})
+}
+
+func (c *PlexClient) GetTraktStatus(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userCtxKey).(*plexUser)
+	writeJson(w, map[string]bool{
+		"linked": c.trakt.IsLinked(strconv.Itoa(user.Id)),
+	})
+}
+
+func (c *PlexClient) UnlinkTrakt(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userCtxKey).(*plexUser)
+	if err := c.trakt.Unlink(strconv.Itoa(user.Id)); err != nil {
+		common.GetLogger().Printf("Failed to save Trakt tokens: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
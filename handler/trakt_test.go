@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xanderstrike/plexhooks"
+)
+
+func newTestTraktClient(t *testing.T, handler http.HandlerFunc) *traktClient {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client, err := newTraktClient(server.URL, "id", "secret", filepath.Join(t.TempDir(), "trakt.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestTraktAuthorizeOnce(t *testing.T) {
+	var requests int32
+	client := newTestTraktClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth/device/code":
+			atomic.AddInt32(&requests, 1)
+			time.Sleep(time.Millisecond * 100)
+			writeJson(w, &traktDeviceCode{
+				DeviceCode:      "device",
+				UserCode:        "USER",
+				VerificationUrl: "https://trakt.tv/activate",
+				ExpiresIn:       1,
+				Interval:        1,
+			})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, err := client.Authorize("1")
+			if err != nil {
+				t.Error(err)
+			} else if code.UserCode != "USER" {
+				t.Errorf("unexpected user code: %q", code.UserCode)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected 1 device code request, got %d", n)
+	}
+}
+
+func TestTraktRefreshOnce(t *testing.T) {
+	var requests int32
+	client := newTestTraktClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if r.URL.Path != "/oauth/token" || body["refresh_token"] != "refresh-0" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(time.Millisecond * 100)
+		writeJson(w, &traktTokenResponse{
+			AccessToken:  "access-1",
+			RefreshToken: "refresh-1",
+			ExpiresIn:    int64(time.Hour * 24 * 90 / time.Second),
+			CreatedAt:    time.Now().Unix(),
+		})
+	})
+	client.tokens["1"] = &traktToken{
+		AccessToken:  "access-0",
+		RefreshToken: "refresh-0",
+		ExpiresAt:    time.Now().Add(time.Hour),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token := client.getAccessToken("1"); token != "access-1" {
+				t.Errorf("unexpected access token: %q", token)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("expected 1 refresh request, got %d", n)
+	}
+	if token := client.getToken("1"); token.RefreshToken != "refresh-1" {
+		t.Errorf("unexpected refresh token: %q", token.RefreshToken)
+	}
+}
+
+func TestTraktScrobbleEpisode(t *testing.T) {
+	bodies := make(chan traktScrobble, 1)
+	client := newTestTraktClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrobble/start" || r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body traktScrobble
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		bodies <- body
+		w.WriteHeader(http.StatusCreated)
+	})
+	client.tokens["1"] = &traktToken{
+		AccessToken: "access",
+		ExpiresAt:   time.Now().Add(time.Hour * 24 * 30),
+	}
+
+	webhook := &plexhooks.PlexResponse{
+		Event: webhookEventPlay,
+		Metadata: plexhooks.Metadata{
+			LibrarySectionType: "show",
+			GrandparentTitle:   "Show",
+			ParentIndex:        2,
+			Index:              5,
+			Duration:           1000,
+			ViewOffset:         500,
+		},
+	}
+	showGuids := []plexhooks.ExternalGuid{{Id: "tvdb://123"}}
+	if !client.Scrobble("1", webhook, showGuids) {
+		t.Fatal("scrobble was not accepted")
+	}
+	body := <-bodies
+	if body.Show == nil || body.Show.Ids["tvdb"] != float64(123) {
+		t.Errorf("unexpected show: %+v", body.Show)
+	}
+	if body.Episode == nil || body.Episode.Season != 2 || body.Episode.Number != 5 {
+		t.Errorf("unexpected episode: %+v", body.Episode)
+	}
+	if body.Progress != 50 {
+		t.Errorf("unexpected progress: %v", body.Progress)
+	}
+}
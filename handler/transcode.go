@@ -0,0 +1,323 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RoyXiang/plexproxy/common"
+	"github.com/jrudio/go-plex-client"
+)
+
+const (
+	transcodeForceDirect    = "force_direct"
+	transcodeAllowTranscode = "allow_transcode"
+	transcodeCap            = "cap"
+
+	networkLan = "lan"
+	networkWan = "wan"
+)
+
+type transcodeRule struct {
+	Users       []string `json:"users"`
+	Products    []string `json:"products"`
+	Platforms   []string `json:"platforms"`
+	Network     string   `json:"network"`
+	Resolutions []string `json:"resolutions"`
+	VideoCodecs []string `json:"video_codecs"`
+	MinBitrate  int      `json:"min_bitrate"`
+
+	Action string `json:"action"`
+	transcodeLimit
+}
+
+type transcodeLimit struct {
+	MaxBitrate    int    `json:"max_bitrate"`
+	MaxResolution string `json:"max_resolution"`
+	MaxQuality    int    `json:"max_quality"`
+}
+
+type transcodeCapRule struct {
+	Users   []string `json:"users"`
+	Network string   `json:"network"`
+	transcodeLimit
+}
+
+func (rule *transcodeRule) init() error {
+	switch rule.Network {
+	case "", networkLan, networkWan:
+	default:
+		return fmt.Errorf("invalid network: %q", rule.Network)
+	}
+	switch rule.Action {
+	case transcodeForceDirect, transcodeAllowTranscode:
+	case transcodeCap:
+		return rule.transcodeLimit.init()
+	default:
+		return fmt.Errorf("invalid transcode action: %q", rule.Action)
+	}
+	return nil
+}
+
+func (limit *transcodeLimit) init() error {
+	if limit.MaxBitrate <= 0 && limit.MaxResolution == "" && limit.MaxQuality <= 0 {
+		return fmt.Errorf("one of max_bitrate, max_resolution and max_quality is required to cap transcoding")
+	} else if limit.MaxResolution != "" && getResolutionPixels(limit.MaxResolution) == 0 {
+		return fmt.Errorf("invalid resolution: %q", limit.MaxResolution)
+	}
+	return nil
+}
+
+// merge tightens the limit with another one
+func (limit *transcodeLimit) merge(other transcodeLimit) {
+	if other.MaxBitrate > 0 && (limit.MaxBitrate <= 0 || other.MaxBitrate < limit.MaxBitrate) {
+		limit.MaxBitrate = other.MaxBitrate
+	}
+	if other.MaxResolution != "" && (limit.MaxResolution == "" || getResolutionPixels(other.MaxResolution) < getResolutionPixels(limit.MaxResolution)) {
+		limit.MaxResolution = other.MaxResolution
+	}
+	if other.MaxQuality > 0 && (limit.MaxQuality <= 0 || other.MaxQuality < limit.MaxQuality) {
+		limit.MaxQuality = other.MaxQuality
+	}
+}
+
+func (rule *transcodeCapRule) init() error {
+	switch rule.Network {
+	case "", networkLan, networkWan:
+	default:
+		return fmt.Errorf("invalid network: %q", rule.Network)
+	}
+	return rule.transcodeLimit.init()
+}
+
+func (rule *transcodeRule) hasMediaCriteria() bool {
+	return len(rule.Resolutions) > 0 || len(rule.VideoCodecs) > 0 || rule.MinBitrate > 0
+}
+
+func (rule *transcodeRule) match(r *http.Request, user *plexUser, getMedia func() *plex.Media) bool {
+	if len(rule.Users) > 0 && !matchUser(rule.Users, user) {
+		return false
+	}
+	if len(rule.Products) > 0 && !containsFold(rule.Products, r.Header.Get(headerProduct)) {
+		return false
+	}
+	if len(rule.Platforms) > 0 && !containsFold(rule.Platforms, r.Header.Get(headerPlatform)) {
+		return false
+	}
+	if rule.Network != "" && rule.Network != getNetworkClass(r) {
+		return false
+	}
+	if rule.hasMediaCriteria() {
+		media := getMedia()
+		if media == nil {
+			return false
+		}
+		if len(rule.Resolutions) > 0 && !containsFold(rule.Resolutions, media.VideoResolution) {
+			return false
+		}
+		if len(rule.VideoCodecs) > 0 && !containsFold(rule.VideoCodecs, media.VideoCodec) {
+			return false
+		}
+		if rule.MinBitrate > 0 && media.Bitrate < rule.MinBitrate {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *PlexClient) applyTranscodePolicy(r *http.Request, user *plexUser) *http.Request {
+	action := transcodeAllowTranscode
+	rule := c.matchTranscodeRule(r, user)
+	if rule != nil {
+		action = rule.Action
+	} else if c.disableTranscode {
+		action = transcodeForceDirect
+	}
+	if action != transcodeForceDirect && c.isTranscodeQuotaReached(r.URL.Query().Get("session")) {
+		metricTranscodeQuotaHits.Add(1)
+		common.GetLogger().Printf("Transcode quota (%d) reached, forcing direct play/stream for %s", c.transcodeQuota, user.Username)
+		action = transcodeForceDirect
+	}
+	switch action {
+	case transcodeForceDirect:
+		return c.disableTranscoding(r)
+	case transcodeCap:
+		return capTranscoding(r, rule.transcodeLimit)
+	}
+	return r
+}
+
+func (c *PlexClient) matchTranscodeRule(r *http.Request, user *plexUser) *transcodeRule {
+	var media *plex.Media
+	mediaFetched := false
+	getMedia := func() *plex.Media {
+		if !mediaFetched {
+			media = c.getDecisionMedia(r)
+			mediaFetched = true
+		}
+		return media
+	}
+	for _, rule := range c.getRules().Transcode {
+		if rule.match(r, user, getMedia) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// isTranscodeQuotaReached counts active video transcodes except the one of the given session
+func (c *PlexClient) isTranscodeQuotaReached(session string) bool {
+	if c.transcodeQuota <= 0 {
+		return false
+	}
+	count := 0
+	for _, key := range c.getTranscodeSessions() {
+		if session == "" || path.Base(key) != session {
+			count++
+		}
+	}
+	return count >= c.transcodeQuota
+}
+
+func (c *PlexClient) getTranscodeSessions() []string {
+	c.MulLock.Lock(lockKeyTranscodes)
+	defer c.MulLock.Unlock(lockKeyTranscodes)
+
+	if time.Since(c.transcodeSessionsAt) < time.Second*5 {
+		return c.transcodeSessions
+	}
+
+	c.MulLock.RLock(lockKeyToken)
+	req, err := http.NewRequest(http.MethodGet, c.client.URL+"/transcode/sessions", nil)
+	if err == nil {
+		req.Header.Set(headerAccept, "application/json")
+		req.Header.Set(headerToken, c.client.Token)
+	}
+	c.MulLock.RUnlock(lockKeyToken)
+	if err != nil {
+		return c.transcodeSessions
+	}
+
+	var result transcodeSessionsResponse
+	resp, err := c.client.HTTPClient.Do(req)
+	if err == nil {
+		defer func(Body io.ReadCloser) {
+			_ = Body.Close()
+		}(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("server replied with %d", resp.StatusCode)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&result)
+		}
+	}
+	if err != nil {
+		common.GetLogger().Printf("Failed to fetch transcode sessions: %s", err.Error())
+		return c.transcodeSessions
+	}
+
+	sessions := make([]string, 0, len(result.MediaContainer.TranscodeSession))
+	for _, session := range result.MediaContainer.TranscodeSession {
+		if session.VideoDecision == "transcode" {
+			sessions = append(sessions, session.Key)
+		}
+	}
+	c.transcodeSessions = sessions
+	c.transcodeSessionsAt = time.Now()
+	metricActiveTranscodes.Set(int64(len(sessions)))
+	return sessions
+}
+
+// getDecisionMedia returns the media which a decision request is about to play
+func (c *PlexClient) getDecisionMedia(r *http.Request) *plex.Media {
+	query := r.URL.Query()
+	itemPath := query.Get("path")
+	if !strings.HasPrefix(itemPath, "/library/metadata/") {
+		return nil
+	}
+	metadata := c.getMetadata(path.Base(itemPath))
+	if metadata == nil || len(metadata.MediaContainer.Metadata) == 0 {
+		return nil
+	}
+	medias := metadata.MediaContainer.Metadata[0].Media
+	index, err := strconv.Atoi(query.Get("mediaIndex"))
+	if err != nil || index < 0 || index >= len(medias) {
+		index = 0
+	}
+	if len(medias) == 0 {
+		return nil
+	}
+	return &medias[index]
+}
+
+// enforceTranscodeCaps applies the strictest limit of all matching caps, which overrides any transcode policy
+func (c *PlexClient) enforceTranscodeCaps(r *http.Request, user *plexUser) *http.Request {
+	var limit transcodeLimit
+	matched := false
+	network := getNetworkClass(r)
+	for _, rule := range c.getRules().Caps {
+		if len(rule.Users) > 0 && !matchUser(rule.Users, user) {
+			continue
+		} else if rule.Network != "" && rule.Network != network {
+			continue
+		}
+		limit.merge(rule.transcodeLimit)
+		matched = true
+	}
+	if !matched {
+		return r
+	}
+	return capTranscoding(r, limit)
+}
+
+func capTranscoding(r *http.Request, limit transcodeLimit) *http.Request {
+	query := r.URL.Query()
+	query.Set("autoAdjustQuality", "0")
+	if limit.MaxBitrate > 0 {
+		if bitrate, err := strconv.Atoi(query.Get("maxVideoBitrate")); err != nil || bitrate <= 0 || bitrate > limit.MaxBitrate {
+			query.Set("maxVideoBitrate", strconv.Itoa(limit.MaxBitrate))
+		}
+		query.Del("videoBitrate")
+	}
+	if limit.MaxResolution != "" {
+		if pixels := getResolutionPixels(query.Get("videoResolution")); pixels == 0 || pixels > getResolutionPixels(limit.MaxResolution) {
+			query.Set("videoResolution", limit.MaxResolution)
+		}
+	}
+	if limit.MaxQuality > 0 {
+		if quality, err := strconv.Atoi(query.Get("videoQuality")); err != nil || quality <= 0 || quality > limit.MaxQuality {
+			query.Set("videoQuality", strconv.Itoa(limit.MaxQuality))
+		}
+	}
+	return cloneRequest(r, r.Header, query)
+}
+
+func getNetworkClass(r *http.Request) string {
+	ip := net.ParseIP(getClientIP(r))
+	if ip != nil && (ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()) {
+		return networkLan
+	}
+	return networkWan
+}
+
+// getResolutionPixels parses a resolution like 1920x1080, returns 0 if it is invalid
+func getResolutionPixels(resolution string) int {
+	parts := strings.Split(resolution, "x")
+	if len(parts) != 2 {
+		return 0
+	}
+	width, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0
+	}
+	height, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0
+	}
+	return width * height
+}
@@ -2,7 +2,10 @@ package handler
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"runtime/debug"
@@ -19,6 +22,12 @@ func wrapResponseWriter(w http.ResponseWriter, protoMajor int) middleware.WrapRe
 }
 
 func modifyResponse(resp *http.Response) error {
+	if err := filterSections(resp); err != nil {
+		return err
+	}
+	if err := recordTranscodeDecision(resp); err != nil {
+		return err
+	}
 	var mediaType string
 	if contentType := resp.Header.Get(headerContentType); contentType != "" {
 		mediaType, _, _ = mime.ParseMediaType(contentType)
@@ -36,6 +45,10 @@ func modifyResponse(resp *http.Response) error {
 }
 
 func proxyErrorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errUpstreamUnavailable) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
 	ctxErr := r.Context().Err()
 	switch ctxErr {
 	case context.Canceled:
@@ -62,26 +75,90 @@ func cloneRequest(r *http.Request, headers http.Header, query url.Values) *http.
 		nr.URL.RawQuery = query.Encode()
 		nr.RequestURI = nr.URL.RequestURI()
 	}
-	if fwd := getIP(headers); fwd != "" {
-		nr.RemoteAddr = fwd
-	}
 	if scheme := getScheme(headers); scheme != "" {
 		nr.URL.Scheme = scheme
 	}
 	return nr
 }
 
-func getIP(headers http.Header) (addr string) {
-	if fwd := headers.Get(headerForwardedFor); fwd != "" {
-		s := strings.Index(fwd, ", ")
-		if s == -1 {
-			s = len(fwd)
+// getForwardedIP returns the address of the client if the request comes from a trusted proxy, addresses in
+// X-Forwarded-For are walked from the right, so that those forged by the client are skipped
+func getForwardedIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	if !isTrustedProxy(net.ParseIP(getClientIP(r)), trustedProxies) {
+		return ""
+	}
+	var addrs []string
+	for _, value := range r.Header.Values(headerForwardedFor) {
+		for _, addr := range strings.Split(value, ",") {
+			addrs = append(addrs, strings.TrimSpace(addr))
 		}
-		addr = fwd[:s]
-	} else if fwd = headers.Get(headerRealIP); fwd != "" {
-		addr = fwd
 	}
-	return
+	for i := len(addrs) - 1; i >= 0; i-- {
+		ip := net.ParseIP(addrs[i])
+		if ip == nil {
+			break
+		} else if i == 0 || !isTrustedProxy(ip, trustedProxies) {
+			return ip.String()
+		}
+	}
+	if ip := net.ParseIP(r.Header.Get(headerRealIP)); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+func isTrustedProxy(ip net.IP, trustedProxies []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetworks parses a comma-separated list of CIDRs, a single address is treated as a network of itself
+func parseNetworks(value string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0)
+	for _, cidr := range strings.Split(value, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func getClientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func writePlexError(w http.ResponseWriter, statusCode int) {
+	status := fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode))
+	w.Header().Set(headerContentType, "text/html")
+	w.WriteHeader(statusCode)
+	_, _ = fmt.Fprintf(w, "<html><head><title>%s</title></head><body><h1>%s</h1></body></html>", http.StatusText(statusCode), status)
 }
 
 func getScheme(headers http.Header) (scheme string) {
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/RoyXiang/plexproxy/common"
+)
+
+type watchedRule struct {
+	Percent   int    `json:"percent"`
+	Remaining string `json:"remaining"`
+	Credits   bool   `json:"credits"`
+
+	remaining time.Duration
+}
+
+func (rule *watchedRule) init() error {
+	if rule.Percent == 0 {
+		rule.Percent = watchedThreshold
+	} else if rule.Percent < 0 || rule.Percent > 100 {
+		return fmt.Errorf("invalid watched percent: %d", rule.Percent)
+	}
+	if rule.Remaining != "" {
+		remaining, err := time.ParseDuration(rule.Remaining)
+		if err != nil || remaining < 0 {
+			return fmt.Errorf("invalid watched remaining: %q", rule.Remaining)
+		}
+		rule.remaining = remaining
+	}
+	return nil
+}
+
+// isWatched checks the position against the rule of the library type, an item is watched once any of the conditions
+// is met: the percentage is reached, the remaining time is short enough, or credits have started
+func (c *PlexClient) isWatched(sectionType, ratingKey string, viewOffset, duration int) bool {
+	if duration <= 0 {
+		return false
+	}
+	rule := c.getRules().Watched[sectionType]
+	if rule == nil {
+		return viewOffset*100 >= watchedThreshold*duration
+	}
+	if viewOffset*100 >= rule.Percent*duration {
+		return true
+	}
+	if rule.remaining > 0 && time.Duration(duration-viewOffset)*time.Millisecond <= rule.remaining {
+		return true
+	}
+	if rule.Credits {
+		if credits := c.getCreditsOffset(ratingKey); credits > 0 && viewOffset >= credits {
+			return true
+		}
+	}
+	return false
+}
+
+// getCreditsOffset returns where the final credits start in milliseconds, or 0 if there is no credits marker
+func (c *PlexClient) getCreditsOffset(ratingKey string) int {
+	if offset, err := c.credits.Get(ratingKey); err == nil {
+		return offset.(int)
+	}
+
+	c.MulLock.RLock(lockKeyToken)
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/library/metadata/%s?includeMarkers=1", c.client.URL, ratingKey), nil)
+	if err == nil {
+		req.Header.Set(headerAccept, "application/json")
+		req.Header.Set(headerToken, c.client.Token)
+	}
+	c.MulLock.RUnlock(lockKeyToken)
+	if err != nil {
+		return 0
+	}
+
+	var result markersResponse
+	resp, err := c.client.HTTPClient.Do(req)
+	if err == nil {
+		defer func(Body io.ReadCloser) {
+			_ = Body.Close()
+		}(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf("server replied with %d", resp.StatusCode)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&result)
+		}
+	}
+	if err != nil {
+		common.GetLogger().Printf("Failed to fetch markers of item %s: %s", ratingKey, err.Error())
+		return 0
+	}
+
+	offset := 0
+	for _, metadata := range result.MediaContainer.Metadata {
+		for _, marker := range metadata.Marker {
+			if marker.Type != "credits" {
+				continue
+			}
+			// prefer the final credits, which would not be followed by a post-credits scene
+			if marker.Final || offset == 0 || marker.StartTimeOffset > offset {
+				offset = marker.StartTimeOffset
+			}
+			if marker.Final {
+				break
+			}
+		}
+	}
+	_ = c.credits.Set(ratingKey, offset)
+	return offset
+}
@@ -0,0 +1,221 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/RoyXiang/plexproxy/signature"
+	"github.com/xanderstrike/plexhooks"
+)
+
+const (
+	webhookFormatPlex   = "plex"
+	webhookFormatSimple = "simple"
+)
+
+type webhookTarget struct {
+	Url     string            `json:"url"`
+	Events  []string          `json:"events"`
+	Users   []string          `json:"users"`
+	Headers map[string]string `json:"headers"`
+	Format  string            `json:"format"`
+}
+
+// plexWebhook extends a Plex webhook with GUIDs of the show, which Plex does not send itself
+type plexWebhook struct {
+	*plexhooks.PlexResponse
+	Metadata plexWebhookMetadata
+}
+
+type plexWebhookMetadata struct {
+	plexhooks.Metadata
+	GrandparentGuid  string                   `json:"grandparentGuid,omitempty"`
+	GrandparentGuids []plexhooks.ExternalGuid `json:"grandparentGuids,omitempty"`
+}
+
+type simpleWebhook struct {
+	Event    string            `json:"event"`
+	Time     time.Time         `json:"time"`
+	User     simpleWebhookUser `json:"user"`
+	ServerId string            `json:"server_id"`
+	PlayerId string            `json:"player_id"`
+	Player   string            `json:"player"`
+	Item     simpleWebhookItem `json:"item"`
+}
+
+type simpleWebhookUser struct {
+	Id       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+type simpleWebhookItem struct {
+	Type       string   `json:"type"`
+	RatingKey  string   `json:"rating_key"`
+	Guid       string   `json:"guid"`
+	Guids      []string `json:"guids"`
+	Title      string   `json:"title"`
+	Year       int      `json:"year"`
+	Duration   int      `json:"duration"`
+	ViewOffset int      `json:"view_offset"`
+	Progress   int      `json:"progress"`
+
+	Show    *simpleWebhookShow `json:"show,omitempty"`
+	Season  int                `json:"season,omitempty"`
+	Episode int                `json:"episode,omitempty"`
+}
+
+type simpleWebhookShow struct {
+	RatingKey string   `json:"rating_key"`
+	Title     string   `json:"title"`
+	Guids     []string `json:"guids"`
+}
+
+func (t *webhookTarget) init() error {
+	if t.Url == "" {
+		return fmt.Errorf("url of webhook is required")
+	}
+	switch t.Format {
+	case "":
+		t.Format = webhookFormatPlex
+	case webhookFormatPlex, webhookFormatSimple:
+	default:
+		return fmt.Errorf("invalid webhook format: %q", t.Format)
+	}
+	for _, event := range t.Events {
+		switch event {
+		case "play", "pause", "resume", "stop", "scrobble":
+		default:
+			return fmt.Errorf("invalid webhook event: %q", event)
+		}
+	}
+	return nil
+}
+
+func (t *webhookTarget) match(event string, user *plexUser) bool {
+	if len(t.Events) > 0 && !containsFold(t.Events, strings.TrimPrefix(event, "media.")) {
+		return false
+	}
+	if len(t.Users) > 0 && !matchUser(t.Users, user) {
+		return false
+	}
+	return true
+}
+
+func (c *PlexClient) isScrobblingEnabled() bool {
+	rules := c.getRules()
+	return c.plaxtUrl != "" || len(rules.Plaxt) > 0 || c.trakt != nil || len(rules.Webhooks) > 0 ||
+		len(rules.Music) > 0 || len(rules.Notifications) > 0 || c.history != nil || c.mqtt != nil
+}
+
+// fanOutWebhook sends the playback event to every matching webhook concurrently
+func (c *PlexClient) fanOutWebhook(user *plexUser, webhook *plexhooks.PlexResponse, showGuid string, showGuids []plexhooks.ExternalGuid) {
+	var plexPayload, simplePayload []byte
+	for _, target := range c.getRules().Webhooks {
+		if !target.match(webhook.Event, user) {
+			continue
+		}
+		var payload []byte
+		switch target.Format {
+		case webhookFormatSimple:
+			if simplePayload == nil {
+				simplePayload, _ = json.Marshal(newSimpleWebhook(user, webhook, showGuids))
+			}
+			payload = simplePayload
+		default:
+			if plexPayload == nil {
+				plexPayload, _ = json.Marshal(newPlexWebhook(webhook, showGuid, showGuids))
+			}
+			payload = plexPayload
+		}
+		go c.deliverWebhook(target.Url, target.Headers, payload, webhook.Event)
+	}
+}
+
+func (c *PlexClient) postWebhook(url string, headers map[string]string, payload []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(headerContentType, "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if len(c.webhookSecret) > 0 {
+		signature.SignRequest(req, c.webhookSecret, payload)
+	}
+	resp, err := c.client.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+	if resp.StatusCode >= http.StatusBadRequest {
+		return resp.StatusCode, fmt.Errorf("server replied with %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func newPlexWebhook(webhook *plexhooks.PlexResponse, showGuid string, showGuids []plexhooks.ExternalGuid) *plexWebhook {
+	return &plexWebhook{
+		PlexResponse: webhook,
+		Metadata: plexWebhookMetadata{
+			Metadata:         webhook.Metadata,
+			GrandparentGuid:  showGuid,
+			GrandparentGuids: showGuids,
+		},
+	}
+}
+
+func newSimpleWebhook(user *plexUser, webhook *plexhooks.PlexResponse, showGuids []plexhooks.ExternalGuid) *simpleWebhook {
+	metadata := webhook.Metadata
+	progress := 0
+	if metadata.Duration > 0 {
+		progress = metadata.ViewOffset * 100 / metadata.Duration
+	}
+	payload := &simpleWebhook{
+		Event: strings.TrimPrefix(webhook.Event, "media."),
+		Time:  time.Now(),
+		User: simpleWebhookUser{
+			Id:       user.Id,
+			Username: user.Username,
+		},
+		ServerId: webhook.Server.Uuid,
+		PlayerId: webhook.Player.Uuid,
+		Player:   webhook.Player.Title,
+		Item: simpleWebhookItem{
+			Type:       metadata.LibrarySectionType,
+			RatingKey:  metadata.RatingKey,
+			Guid:       metadata.Guid,
+			Guids:      getGuidIds(metadata.ExternalGuid),
+			Title:      metadata.Title,
+			Year:       metadata.Year,
+			Duration:   metadata.Duration,
+			ViewOffset: metadata.ViewOffset,
+			Progress:   progress,
+		},
+	}
+	if metadata.GrandparentRatingKey != "" {
+		payload.Item.Show = &simpleWebhookShow{
+			RatingKey: metadata.GrandparentRatingKey,
+			Title:     metadata.GrandparentTitle,
+			Guids:     getGuidIds(showGuids),
+		}
+		payload.Item.Season = metadata.ParentIndex
+		payload.Item.Episode = metadata.Index
+	}
+	return payload
+}
+
+func getGuidIds(guids []plexhooks.ExternalGuid) []string {
+	ids := make([]string, 0, len(guids))
+	for _, guid := range guids {
+		ids = append(ids, guid.Id)
+	}
+	return ids
+}
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/xanderstrike/plexhooks"
+)
+
+func TestPlexWebhookShowGuids(t *testing.T) {
+	webhook := &plexhooks.PlexResponse{
+		Event: webhookEventScrobble,
+		Metadata: plexhooks.Metadata{
+			Type:             "episode",
+			Guid:             "plex://episode/1",
+			ExternalGuid:     []plexhooks.ExternalGuid{{Id: "tvdb://2"}},
+			GrandparentTitle: "Show",
+		},
+	}
+	b, err := json.Marshal(newPlexWebhook(webhook, "plex://show/1", []plexhooks.ExternalGuid{{Id: "tvdb://1"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var payload struct {
+		Event    string
+		Metadata struct {
+			Guid             string                   `json:"guid"`
+			ExternalGuid     []plexhooks.ExternalGuid `json:"Guid"`
+			GrandparentTitle string
+			GrandparentGuid  string                   `json:"grandparentGuid"`
+			GrandparentGuids []plexhooks.ExternalGuid `json:"grandparentGuids"`
+		}
+	}
+	if err = json.Unmarshal(b, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Event != webhookEventScrobble || payload.Metadata.GrandparentTitle != "Show" {
+		t.Errorf("unexpected payload: %s", b)
+	}
+	if payload.Metadata.Guid != "plex://episode/1" || len(payload.Metadata.ExternalGuid) != 1 {
+		t.Errorf("unexpected episode GUIDs: %s", b)
+	}
+	if payload.Metadata.GrandparentGuid != "plex://show/1" || len(payload.Metadata.GrandparentGuids) != 1 ||
+		payload.Metadata.GrandparentGuids[0].Id != "tvdb://1" {
+		t.Errorf("unexpected show GUIDs: %s", b)
+	}
+}
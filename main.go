@@ -36,6 +36,7 @@ func main() {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*15)
 	defer cancel()
 	_ = srv.Shutdown(ctx)
+	handler.Shutdown()
 
 	common.GetLogger().Println("Shutting down...")
 	os.Exit(0)
@@ -0,0 +1,79 @@
+// Package signature signs webhooks sent by plexproxy, and verifies them for receivers.
+//
+// A signature is the hex-encoded HMAC-SHA256 of the timestamp, a dot and the body, keyed by the shared secret. It is
+// sent in HeaderSignature prefixed with "sha256=", along with the Unix timestamp in HeaderTimestamp.
+package signature
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderSignature = "X-Plexproxy-Signature"
+	HeaderTimestamp = "X-Plexproxy-Timestamp"
+
+	prefix = "sha256="
+)
+
+var (
+	ErrMissingHeader    = errors.New("signature or timestamp header is missing")
+	ErrInvalidTimestamp = errors.New("timestamp is invalid or out of tolerance")
+	ErrInvalidSignature = errors.New("signature does not match")
+)
+
+// Sign returns the value of HeaderSignature for the body sent at the timestamp
+func Sign(secret []byte, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return prefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest sets the timestamp and signature headers of a request with the body
+func SignRequest(r *http.Request, secret []byte, body []byte) {
+	timestamp := time.Now().Unix()
+	r.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	r.Header.Set(HeaderSignature, Sign(secret, timestamp, body))
+}
+
+// Verify checks the signature of the body, and that the timestamp is within tolerance of now, a zero tolerance
+// skips checking the timestamp
+func Verify(secret []byte, timestamp, signature string, body []byte, tolerance time.Duration) error {
+	if timestamp == "" || signature == "" {
+		return ErrMissingHeader
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidTimestamp
+	}
+	if tolerance > 0 {
+		if diff := time.Since(time.Unix(ts, 0)); diff > tolerance || diff < -tolerance {
+			return ErrInvalidTimestamp
+		}
+	}
+	if !strings.HasPrefix(signature, prefix) || !hmac.Equal([]byte(signature), []byte(Sign(secret, ts, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// VerifyRequest reads the body of a request and verifies it, the body could still be read afterwards
+func VerifyRequest(r *http.Request, secret []byte, tolerance time.Duration) error {
+	body, err := io.ReadAll(r.Body)
+	_ = r.Body.Close()
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return Verify(secret, r.Header.Get(HeaderTimestamp), r.Header.Get(HeaderSignature), body, tolerance)
+}
@@ -0,0 +1,74 @@
+package signature
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var (
+	secret = []byte("secret")
+	body   = []byte(`{"event":"play"}`)
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Now().Unix()
+	timestamp := strconv.FormatInt(now, 10)
+	signature := Sign(secret, now, body)
+
+	tests := []struct {
+		name      string
+		secret    []byte
+		timestamp string
+		signature string
+		body      []byte
+		tolerance time.Duration
+		err       error
+	}{
+		{"round trip", secret, timestamp, signature, body, time.Minute, nil},
+		{"tampered body", secret, timestamp, signature, []byte(`{"event":"stop"}`), time.Minute, ErrInvalidSignature},
+		{"wrong secret", []byte("other"), timestamp, signature, body, time.Minute, ErrInvalidSignature},
+		{"tampered timestamp", secret, strconv.FormatInt(now+1, 10), signature, body, time.Minute, ErrInvalidSignature},
+		{"missing prefix", secret, timestamp, signature[len(prefix):], body, time.Minute, ErrInvalidSignature},
+		{"missing signature", secret, timestamp, "", body, time.Minute, ErrMissingHeader},
+		{"missing timestamp", secret, "", signature, body, time.Minute, ErrMissingHeader},
+		{"invalid timestamp", secret, "now", signature, body, time.Minute, ErrInvalidTimestamp},
+		{"stale timestamp", secret, strconv.FormatInt(now-120, 10), Sign(secret, now-120, body), body, time.Minute, ErrInvalidTimestamp},
+		{"future timestamp", secret, strconv.FormatInt(now+120, 10), Sign(secret, now+120, body), body, time.Minute, ErrInvalidTimestamp},
+		{"zero tolerance", secret, "0", Sign(secret, 0, body), body, 0, nil},
+		{"zero tolerance with wrong secret", []byte("other"), "0", Sign(secret, 0, body), body, 0, ErrInvalidSignature},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := Verify(test.secret, test.timestamp, test.signature, test.body, test.tolerance); !errors.Is(err, test.err) {
+				t.Errorf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+	SignRequest(r, secret, body)
+	if err := VerifyRequest(r, secret, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, body) {
+		t.Errorf("unexpected body after verifying: %s", b)
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader([]byte(`{}`)))
+	SignRequest(r, secret, body)
+	if err = VerifyRequest(r, secret, time.Minute); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("expected %v, got %v", ErrInvalidSignature, err)
+	}
+}